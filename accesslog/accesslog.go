@@ -0,0 +1,148 @@
+// Package accesslog parses the JSON access logs nginx writes when the
+// watcher runs with NGINX_LOG_FORMAT=json.
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a line of a JSON access log. The upstream fields list every
+// server tried, separated by ", " and by " : " across internal redirects,
+// and are "-" for requests served without an upstream. The trace fields are
+// only written when tracing is enabled.
+type Entry struct {
+	Time                 time.Time `json:"time"`
+	RemoteAddr           string    `json:"remote_addr"`
+	RequestID            string    `json:"request_id"`
+	TraceID              string    `json:"trace_id"`
+	SpanID               string    `json:"span_id"`
+	ParentSpanID         string    `json:"parent_span_id"`
+	Host                 string    `json:"host"`
+	ServerName           string    `json:"server_name"`
+	Method               string    `json:"method"`
+	URI                  string    `json:"uri"`
+	Protocol             string    `json:"protocol"`
+	Status               int       `json:"status"`
+	BodyBytesSent        int64     `json:"body_bytes_sent"`
+	RequestTime          float64   `json:"request_time"`
+	UpstreamAddr         string    `json:"upstream_addr"`
+	UpstreamStatus       string    `json:"upstream_status"`
+	UpstreamResponseTime string    `json:"upstream_response_time"`
+	CacheStatus          string    `json:"cache_status"`
+	Location             string    `json:"location"`
+	App                  string    `json:"app"`
+	Proc                 string    `json:"proc"`
+	Canary               bool      `json:"canary"`
+	Referer              string    `json:"referer"`
+	UserAgent            string    `json:"user_agent"`
+	XForwardedFor        string    `json:"x_forwarded_for"`
+}
+
+// Parse parses a line of a JSON access log. nginx before 1.11.8 cannot
+// escape its variables for JSON, quotes, backslashes and the bytes out of
+// printable ASCII are escaped as \xHH instead and decoded here.
+func Parse(line []byte) (Entry, error) {
+	var entry Entry
+	err := json.Unmarshal(unescapeHex(line), &entry)
+	return entry, err
+}
+
+// unescapeHex replaces the \xHH escapes of line by the JSON escapes of their
+// ASCII bytes, or by the bytes themselves to keep UTF-8 strings whole.
+func unescapeHex(line []byte) []byte {
+	if !bytes.Contains(line, []byte(`\x`)) {
+		return line
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(line); i++ {
+		if line[i] != '\\' || i+1 == len(line) {
+			buf.WriteByte(line[i])
+			continue
+		}
+		if line[i+1] == 'x' && i+3 < len(line) {
+			if b, err := strconv.ParseUint(string(line[i+2:i+4]), 16, 8); err == nil {
+				if b < 0x80 {
+					fmt.Fprintf(&buf, `\u%04x`, b)
+				} else {
+					buf.WriteByte(byte(b))
+				}
+				i += 3
+				continue
+			}
+		}
+		// Other escapes are copied whole, an escaped backslash is not
+		// the start of a \x escape.
+		buf.Write(line[i : i+2])
+		i++
+	}
+	return buf.Bytes()
+}
+
+// UpstreamAddrs returns the addresses of the upstream servers tried.
+func (e Entry) UpstreamAddrs() []string {
+	return split(e.UpstreamAddr)
+}
+
+// UpstreamTime returns the time spent waiting for upstream servers in
+// seconds, summed over every server tried.
+func (e Entry) UpstreamTime() float64 {
+	var total float64
+	for _, s := range split(e.UpstreamResponseTime) {
+		if t, err := strconv.ParseFloat(s, 64); err == nil {
+			total += t
+		}
+	}
+	return total
+}
+
+func split(s string) []string {
+	var values []string
+	for _, group := range strings.Split(s, " : ") {
+		for _, value := range strings.Split(group, ", ") {
+			if value = strings.TrimSpace(value); value != "" && value != "-" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// Parser reads the entries of a JSON access log one line at a time.
+type Parser struct {
+	reader  *bufio.Reader
+	partial []byte
+}
+
+// NewParser returns a parser reading r.
+func NewParser(r io.Reader) *Parser {
+	return &Parser{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next entry, skipping blank lines. At the end of the log it
+// returns io.EOF and keeps a partial last line, which nginx may still be
+// writing, for the next call.
+func (p *Parser) Next() (Entry, error) {
+	for {
+		line, err := p.reader.ReadBytes('\n')
+		if err != nil {
+			p.partial = append(p.partial, line...)
+			return Entry{}, err
+		}
+		if len(p.partial) > 0 {
+			line = append(p.partial, line...)
+			p.partial = nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		return Parse(line)
+	}
+}
@@ -0,0 +1,78 @@
+package accesslog
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseEscapes(t *testing.T) {
+	tests := []struct {
+		line      string
+		uri       string
+		userAgent string
+	}{
+		// escape=json
+		{`{"uri":"/a\"b\\x41","user_agent":"café"}`, `/a"b\x41`, "café"},
+		// the default escaping of nginx before 1.11.8
+		{`{"uri":"/a\x22b\x5Cx41","user_agent":"caf\xC3\xA9"}`, `/a"b\x41`, "café"},
+		{`{"uri":"/\x0A\x7F","user_agent":"-"}`, "/\n\x7f", "-"},
+	}
+	for _, test := range tests {
+		entry, err := Parse([]byte(test.line))
+		if err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		if entry.URI != test.uri || entry.UserAgent != test.userAgent {
+			t.Errorf("%s: uri %q user agent %q, want %q %q", test.line, entry.URI, entry.UserAgent, test.uri, test.userAgent)
+		}
+	}
+}
+
+func TestEntryUpstream(t *testing.T) {
+	tests := []struct {
+		addr  string
+		time  string
+		addrs []string
+		total float64
+	}{
+		{"-", "-", nil, 0},
+		{"172.20.0.1:8080", "0.120", []string{"172.20.0.1:8080"}, 0.12},
+		// retried on the next server
+		{"172.20.0.1:8080, 172.20.0.2:8080", "0.500, 0.250", []string{"172.20.0.1:8080", "172.20.0.2:8080"}, 0.75},
+		// internal redirect to an error page served without upstream
+		{"172.20.0.1:8080 : -", "1.000 : -", []string{"172.20.0.1:8080"}, 1},
+	}
+	for _, test := range tests {
+		entry := Entry{UpstreamAddr: test.addr, UpstreamResponseTime: test.time}
+		if got := entry.UpstreamAddrs(); !reflect.DeepEqual(got, test.addrs) {
+			t.Errorf("%q: addrs %q, want %q", test.addr, got, test.addrs)
+		}
+		if got := entry.UpstreamTime(); math.Abs(got-test.total) > 1e-9 {
+			t.Errorf("%q: upstream time %v, want %v", test.time, got, test.total)
+		}
+	}
+}
+
+func TestParserPartialLine(t *testing.T) {
+	var log bytes.Buffer
+	p := NewParser(&log)
+	log.WriteString(`{"uri":"/a"}` + "\n\n" + `{"uri":`)
+	if entry, err := p.Next(); err != nil || entry.URI != "/a" {
+		t.Errorf("first entry %q %v, want /a", entry.URI, err)
+	}
+	if _, err := p.Next(); err != io.EOF {
+		t.Errorf("partial line read with %v, want EOF", err)
+	}
+	// nginx ends the line.
+	log.WriteString(`"/b"}` + "\n")
+	if entry, err := p.Next(); err != nil || entry.URI != "/b" {
+		t.Errorf("second entry %q %v, want /b", entry.URI, err)
+	}
+	if _, err := p.Next(); err != io.EOF {
+		t.Errorf("end of log read with %v, want EOF", err)
+	}
+}
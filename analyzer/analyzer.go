@@ -0,0 +1,222 @@
+// Package analyzer tails the JSON access logs of nginx and aggregates
+// request counts, status classes and latencies per server, location and
+// upstream.
+package analyzer
+
+import (
+	"github.com/laincloud/webrouter/accesslog"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSamples bounds the latencies kept per key and window to compute the
+// percentiles.
+const maxSamples = 10000
+
+// Key identifies what the requests are aggregated by. Canary requests are
+// counted under the canary upstream.
+type Key struct {
+	Server   string
+	Location string
+	Upstream string
+}
+
+// Stat is the aggregate of the requests of a key over a window. Status
+// counts the 1xx to 5xx responses, latencies are in seconds.
+type Stat struct {
+	Key
+	Requests int64
+	Status   [5]int64
+	P50      float64
+	P90      float64
+	P99      float64
+}
+
+// Metrics returns the metrics of the stat keyed by dotted names relative to
+// the key, with latencies in milliseconds.
+func (s Stat) Metrics() map[string]float64 {
+	return map[string]float64{
+		"requests":    float64(s.Requests),
+		"status_2xx":  float64(s.Status[1]),
+		"status_3xx":  float64(s.Status[2]),
+		"status_4xx":  float64(s.Status[3]),
+		"status_5xx":  float64(s.Status[4]),
+		"latency_p50": s.P50 * 1000,
+		"latency_p90": s.P90 * 1000,
+		"latency_p99": s.P99 * 1000,
+	}
+}
+
+type counter struct {
+	requests int64
+	status   [5]int64
+	duration float64
+}
+
+type window struct {
+	counter
+	samples []float64
+}
+
+// Analyzer follows the access logs of a directory. Counters are kept since
+// the start for Prometheus, windows are reset every interval.
+type Analyzer struct {
+	sync.Mutex
+	logPath string
+	tailers map[string]*tailer
+	totals  map[Key]*counter
+	windows map[Key]*window
+	last    []Stat
+	invalid int64
+}
+
+// New returns an analyzer of the *access.log files in logPath.
+func New(logPath string) *Analyzer {
+	return &Analyzer{
+		logPath: logPath,
+		tailers: make(map[string]*tailer),
+		totals:  make(map[Key]*counter),
+		windows: make(map[Key]*window),
+	}
+}
+
+// Run polls the logs every second and calls flush with the stats of every
+// window of interval. Logs present when Run starts are read from their end.
+func (a *Analyzer) Run(interval time.Duration, flush func([]Stat)) {
+	a.scan(true)
+	poll := time.NewTicker(time.Second)
+	rotate := time.NewTicker(interval)
+	for {
+		select {
+		case <-poll.C:
+			a.scan(false)
+			a.poll()
+		case <-rotate.C:
+			stats := a.rotate()
+			if flush != nil {
+				flush(stats)
+			}
+		}
+	}
+}
+
+// scan starts following the logs which appeared since the last scan.
+func (a *Analyzer) scan(fromEnd bool) {
+	paths, err := filepath.Glob(a.logPath + "*access.log")
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	for _, path := range paths {
+		if _, ok := a.tailers[path]; ok || strings.HasPrefix(filepath.Base(path), "stream___") {
+			continue
+		}
+		t, err := newTailer(path, fromEnd)
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+		a.tailers[path] = t
+	}
+}
+
+func (a *Analyzer) poll() {
+	for path, t := range a.tailers {
+		invalid, err := t.poll(a.add)
+		if invalid > 0 {
+			a.Lock()
+			a.invalid += int64(invalid)
+			a.Unlock()
+		}
+		if err != nil {
+			if err == errRemoved {
+				log.WithField("path", path).Infoln(err)
+			} else {
+				log.WithField("path", path).Errorln(err)
+			}
+			t.close()
+			delete(a.tailers, path)
+		}
+	}
+}
+
+func (a *Analyzer) add(entry accesslog.Entry) {
+	if entry.Proc == "" {
+		return
+	}
+	key := Key{
+		Server:   entry.ServerName,
+		Location: entry.Location,
+		Upstream: strings.Replace(entry.Proc, ".", "_", -1),
+	}
+	if entry.Canary {
+		key.Upstream += "_canary"
+	}
+	a.Lock()
+	defer a.Unlock()
+	total, ok := a.totals[key]
+	if !ok {
+		total = new(counter)
+		a.totals[key] = total
+	}
+	w, ok := a.windows[key]
+	if !ok {
+		w = new(window)
+		a.windows[key] = w
+	}
+	for _, c := range []*counter{total, &w.counter} {
+		c.requests++
+		if class := entry.Status/100 - 1; class >= 0 && class < 5 {
+			c.status[class]++
+		}
+		c.duration += entry.RequestTime
+	}
+	if len(w.samples) < maxSamples {
+		w.samples = append(w.samples, entry.RequestTime)
+	}
+}
+
+// rotate ends the current window and returns its stats, sorted by key.
+func (a *Analyzer) rotate() []Stat {
+	a.Lock()
+	defer a.Unlock()
+	stats := make([]Stat, 0, len(a.windows))
+	for key, w := range a.windows {
+		sort.Float64s(w.samples)
+		stats = append(stats, Stat{
+			Key:      key,
+			Requests: w.requests,
+			Status:   w.status,
+			P50:      percentile(w.samples, 0.5),
+			P90:      percentile(w.samples, 0.9),
+			P99:      percentile(w.samples, 0.99),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return less(stats[i].Key, stats[j].Key)
+	})
+	a.windows = make(map[Key]*window)
+	a.last = stats
+	return stats
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
+
+func less(a, b Key) bool {
+	if a.Server != b.Server {
+		return a.Server < b.Server
+	}
+	if a.Location != b.Location {
+		return a.Location < b.Location
+	}
+	return a.Upstream < b.Upstream
+}
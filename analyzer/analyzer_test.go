@@ -0,0 +1,59 @@
+package analyzer
+
+import (
+	"github.com/laincloud/webrouter/accesslog"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAggregation(t *testing.T) {
+	a := New("")
+	entries := []accesslog.Entry{
+		{ServerName: "a.org", Location: "/", Proc: "a.web.web", Status: 200, RequestTime: 0.1},
+		{ServerName: "a.org", Location: "/", Proc: "a.web.web", Status: 201, RequestTime: 0.3},
+		{ServerName: "a.org", Location: "/", Proc: "a.web.web", Status: 302, RequestTime: 0.2},
+		{ServerName: "a.org", Location: "/", Proc: "a.web.web", Status: 404, RequestTime: 0.4},
+		{ServerName: "a.org", Location: "/", Proc: "a.web.web", Status: 502, RequestTime: 1},
+		{ServerName: "a.org", Location: "/", Proc: "a.web.web", Status: 200, RequestTime: 0.5, Canary: true},
+		{ServerName: "a.org", Location: "/api", Proc: "b.web.web", Status: 499, RequestTime: 2},
+		// Served without a proc, like the redirects to https.
+		{ServerName: "a.org", Location: "/", Status: 301},
+	}
+	for _, entry := range entries {
+		a.add(entry)
+	}
+	want := []Stat{
+		{Key: Key{"a.org", "/", "a_web_web"}, Requests: 5, Status: [5]int64{0, 2, 1, 1, 1}, P50: 0.3, P90: 1, P99: 1},
+		{Key: Key{"a.org", "/", "a_web_web_canary"}, Requests: 1, Status: [5]int64{0, 1, 0, 0, 0}, P50: 0.5, P90: 0.5, P99: 0.5},
+		{Key: Key{"a.org", "/api", "b_web_web"}, Requests: 1, Status: [5]int64{0, 0, 0, 1, 0}, P50: 2, P90: 2, P99: 2},
+	}
+	if stats := a.rotate(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats\n%+v\nwant\n%+v", stats, want)
+	}
+
+	// Windows are reset, totals are kept.
+	a.add(entries[0])
+	want = []Stat{
+		{Key: Key{"a.org", "/", "a_web_web"}, Requests: 1, Status: [5]int64{0, 1, 0, 0, 0}, P50: 0.1, P90: 0.1, P99: 0.1},
+	}
+	if stats := a.rotate(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("second window\n%+v\nwant\n%+v", stats, want)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`webrouter_requests_total{server="a.org",location="/",upstream="a_web_web",status="2xx"} 3`,
+		`webrouter_requests_total{server="a.org",location="/api",upstream="b_web_web",status="4xx"} 1`,
+		`webrouter_request_duration_seconds{server="a.org",location="/",upstream="a_web_web",quantile="0.5"} 0.1`,
+		`webrouter_request_duration_seconds_count{server="a.org",location="/",upstream="a_web_web"} 6`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("no %s in\n%s", line, w.Body.String())
+		}
+	}
+	if strings.Contains(w.Body.String(), `upstream="b_web_web",quantile`) {
+		t.Errorf("quantiles of a key without requests in the last window in\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,56 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(key Key) string {
+	return `server="` + labelReplacer.Replace(key.Server) +
+		`",location="` + labelReplacer.Replace(key.Location) +
+		`",upstream="` + labelReplacer.Replace(key.Upstream) + `"`
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format: request
+// counters since the start and the latency quantiles of the last window.
+func (a *Analyzer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	defer a.Unlock()
+	keys := make([]Key, 0, len(a.totals))
+	for key := range a.totals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return less(keys[i], keys[j])
+	})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP webrouter_requests_total Requests by status class.")
+	fmt.Fprintln(w, "# TYPE webrouter_requests_total counter")
+	for _, key := range keys {
+		for class, count := range a.totals[key].status {
+			fmt.Fprintf(w, "webrouter_requests_total{%s,status=\"%dxx\"} %d\n", labels(key), class+1, count)
+		}
+	}
+	fmt.Fprintln(w, "# HELP webrouter_request_duration_seconds Request time, quantiles over the last window.")
+	fmt.Fprintln(w, "# TYPE webrouter_request_duration_seconds summary")
+	quantiles := make(map[Key]Stat)
+	for _, stat := range a.last {
+		quantiles[stat.Key] = stat
+	}
+	for _, key := range keys {
+		if stat, ok := quantiles[key]; ok {
+			fmt.Fprintf(w, "webrouter_request_duration_seconds{%s,quantile=\"0.5\"} %g\n", labels(key), stat.P50)
+			fmt.Fprintf(w, "webrouter_request_duration_seconds{%s,quantile=\"0.9\"} %g\n", labels(key), stat.P90)
+			fmt.Fprintf(w, "webrouter_request_duration_seconds{%s,quantile=\"0.99\"} %g\n", labels(key), stat.P99)
+		}
+		fmt.Fprintf(w, "webrouter_request_duration_seconds_sum{%s} %g\n", labels(key), a.totals[key].duration)
+		fmt.Fprintf(w, "webrouter_request_duration_seconds_count{%s} %d\n", labels(key), a.totals[key].requests)
+	}
+	fmt.Fprintln(w, "# HELP webrouter_access_log_invalid_lines_total Access log lines which could not be parsed.")
+	fmt.Fprintln(w, "# TYPE webrouter_access_log_invalid_lines_total counter")
+	fmt.Fprintf(w, "webrouter_access_log_invalid_lines_total %d\n", a.invalid)
+}
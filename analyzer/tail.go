@@ -0,0 +1,117 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/laincloud/webrouter/accesslog"
+	"io"
+	"os"
+	"time"
+)
+
+// tailer follows an access log across logrotate, which renames the log,
+// creates a new one and sends USR1 to nginx to reopen it: the renamed file is
+// read until nginx writes to the new one, then read to its end and closed
+// before the new one is read from its start. A log which is not created again
+// within removedTimeout was removed, like the logs of a deleted server, and
+// its tailer is closed.
+type tailer struct {
+	path    string
+	file    *os.File
+	parser  *accesslog.Parser
+	removed time.Time
+}
+
+const removedTimeout = time.Minute
+
+var errRemoved = errors.New("access log removed !")
+
+func newTailer(path string, fromEnd bool) (*tailer, error) {
+	t := &tailer{path: path}
+	if err := t.open(fromEnd); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tailer) open(fromEnd bool) error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	if fromEnd {
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	t.file = file
+	t.parser = accesslog.NewParser(file)
+	return nil
+}
+
+// poll calls handle for every entry written since the last poll and returns
+// the number of lines which could not be parsed.
+func (t *tailer) poll(handle func(accesslog.Entry)) (int, error) {
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		// Renamed, the new log has not been created yet.
+		if t.removed.IsZero() {
+			t.removed = time.Now()
+		}
+		invalid := t.read(handle)
+		if time.Since(t.removed) > removedTimeout {
+			return invalid, errRemoved
+		}
+		return invalid, nil
+	} else if err != nil {
+		return 0, err
+	}
+	t.removed = time.Time{}
+	current, err := t.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	offset, err := t.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if os.SameFile(info, current) && info.Size() < offset {
+		// Truncated.
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		t.parser = accesslog.NewParser(t.file)
+	}
+	// Read after the stat of the new log, so that the renamed one is read
+	// to its end once nginx writes to the new one.
+	invalid := t.read(handle)
+	if os.SameFile(info, current) || info.Size() == 0 {
+		// Not rotated, or nginx has not reopened the log yet.
+		return invalid, nil
+	}
+	t.file.Close()
+	if err := t.open(false); err != nil {
+		return invalid, err
+	}
+	return invalid + t.read(handle), nil
+}
+
+func (t *tailer) read(handle func(accesslog.Entry)) int {
+	invalid := 0
+	for {
+		entry, err := t.parser.Next()
+		switch err.(type) {
+		case nil:
+			handle(entry)
+		case *json.SyntaxError, *json.UnmarshalTypeError, *time.ParseError:
+			invalid++
+		default:
+			return invalid
+		}
+	}
+}
+
+func (t *tailer) close() error {
+	return t.file.Close()
+}
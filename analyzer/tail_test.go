@@ -0,0 +1,126 @@
+package analyzer
+
+import (
+	"fmt"
+	"github.com/laincloud/webrouter/accesslog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func appendLines(t *testing.T, path string, uris ...string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, uri := range uris {
+		if uri == "invalid" {
+			fmt.Fprintln(f, "{")
+			continue
+		}
+		fmt.Fprintf(f, `{"time":"2018-06-19T11:44:00+08:00","uri":"%s","status":200}`+"\n", uri)
+	}
+}
+
+func TestTailerRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "analyzer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.access.log")
+	appendLines(t, path, "/1", "/2")
+	tailer, err := newTailer(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.close()
+
+	steps := []struct {
+		name  string
+		write func()
+		uris  []string
+	}{
+		{"start", func() {}, []string{"/1", "/2"}},
+		{"append", func() { appendLines(t, path, "/3", "invalid") }, []string{"/3"}},
+		{"rename", func() {
+			appendLines(t, path, "/4")
+			if err := os.Rename(path, path+".1"); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"/4"}},
+		{"create", func() {
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			appendLines(t, path+".1", "/5")
+		}, []string{"/5"}},
+		// The last lines of the renamed log are read before the new one.
+		{"reopen", func() {
+			appendLines(t, path+".1", "/6")
+			appendLines(t, path, "/7")
+		}, []string{"/6", "/7"}},
+		{"renamed log removed", func() {
+			os.Remove(path + ".1")
+			appendLines(t, path, "/8")
+		}, []string{"/8"}},
+		{"truncate", func() {
+			if err := os.Truncate(path, 0); err != nil {
+				t.Fatal(err)
+			}
+			appendLines(t, path, "/9")
+		}, []string{"/9"}},
+	}
+	for _, step := range steps {
+		step.write()
+		var uris []string
+		invalid, err := tailer.poll(func(entry accesslog.Entry) {
+			uris = append(uris, entry.URI)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(uris, step.uris) {
+			t.Errorf("%s: read %q, want %q", step.name, uris, step.uris)
+		}
+		if step.name == "append" && invalid != 1 {
+			t.Errorf("%s: %d invalid lines, want 1", step.name, invalid)
+		}
+	}
+}
+
+func TestAnalyzerRemovedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "analyzer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.access.log")
+	appendLines(t, path, "/1")
+	a := New(dir + "/")
+	a.scan(false)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	a.poll()
+	tailer, ok := a.tailers[path]
+	if !ok {
+		t.Fatal("tailer closed as soon as the log was removed")
+	}
+	tailer.removed = tailer.removed.Add(-removedTimeout)
+	a.poll()
+	if _, ok := a.tailers[path]; ok {
+		t.Fatalf("tailer kept %s after the log was removed", removedTimeout)
+	}
+	appendLines(t, path, "/2")
+	a.scan(false)
+	if _, ok := a.tailers[path]; !ok {
+		t.Error("log created again not followed")
+	}
+	for _, tailer := range a.tailers {
+		tailer.close()
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"github.com/hashicorp/go-cleanhttp"
 	"github.com/laincloud/webrouter/graphite"
 	"github.com/laincloud/webrouter/lainlet"
+	"github.com/laincloud/webrouter/metrics"
 	"github.com/onrik/logrus/filename"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"os"
 	"time"
 )
 
@@ -21,6 +23,13 @@ func main() {
 	viper.SetDefault("graphite", false)
 	viper.SetDefault("graphiteHost", nil)
 	viper.SetDefault("graphitePort", nil)
+	viper.SetDefault("graphiteProtocol", "tcp")
+	viper.SetDefault("graphiteFormat", "plaintext")
+	viper.SetDefault("graphitePrefix", graphite.ConfdPrefix)
+	viper.SetDefault("metrics", "")
+	viper.SetDefault("metricsTags", "")
+	viper.SetDefault("statsd", "127.0.0.1:8125")
+	viper.SetDefault("otlp", "http://127.0.0.1:4318/v1/metrics")
 
 	viper.BindEnv("lainlet", "LAINLET_ADDR")
 	viper.BindEnv("consul", "CONSUL_ADDR")
@@ -28,16 +37,48 @@ func main() {
 	viper.BindEnv("graphite", "GRAPHITE_ENABLE")
 	viper.BindEnv("graphiteHost", "GRAPHITE_HOST")
 	viper.BindEnv("graphitePort", "GRAPHITE_PORT")
+	viper.BindEnv("graphiteProtocol", "GRAPHITE_PROTOCOL")
+	viper.BindEnv("graphiteFormat", "GRAPHITE_FORMAT")
+	viper.BindEnv("graphitePrefix", "GRAPHITE_PREFIX")
+	viper.BindEnv("metrics", "METRICS_REPORTER")
+	viper.BindEnv("metricsTags", "METRICS_TAGS")
+	viper.BindEnv("statsd", "STATSD_ADDR")
+	viper.BindEnv("otlp", "OTLP_ENDPOINT")
 
 	lainletAddr := viper.GetString("lainlet")
 	consulAddr := viper.GetString("consul")
 	prefix := viper.GetString("prefix")
-	graphiteEnable := viper.GetBool("graphite")
-	var graphiteHost string
-	var graphitePort int
-	if graphiteEnable {
-		graphiteHost = viper.GetString("graphiteHost")
-		graphitePort = viper.GetInt("graphitePort")
+	// GRAPHITE_ENABLE is kept for the deployments predating METRICS_REPORTER.
+	metricsReporter := viper.GetString("metrics")
+	if metricsReporter == "" && viper.GetBool("graphite") {
+		metricsReporter = "graphite"
+	}
+	var reporter metrics.Reporter
+	if metricsReporter != "" {
+		tags, err := metrics.ParseTags(viper.GetString("metricsTags"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tags = append([]metrics.Tag{
+			{Key: "lain_domain", Value: os.Getenv("LAIN_DOMAIN")},
+		}, tags...)
+		reporter, err = metrics.New(metrics.Config{
+			Reporter:  metricsReporter,
+			Component: "confd",
+			Tags:      tags,
+			Graphite: graphite.Config{
+				Host:     viper.GetString("graphiteHost"),
+				Port:     viper.GetInt("graphitePort"),
+				Protocol: viper.GetString("graphiteProtocol"),
+				Format:   viper.GetString("graphiteFormat"),
+				Prefix:   viper.GetString("graphitePrefix"),
+			},
+			StatsDAddr:   viper.GetString("statsd"),
+			OTLPEndpoint: viper.GetString("otlp"),
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
 	config := &api.Config{
@@ -54,10 +95,13 @@ func main() {
 	health := 1
 
 	ticker := time.NewTicker(1 * time.Minute)
-	if graphiteEnable {
+	if reporter != nil {
 		go func() {
 			for range ticker.C {
-				graphite.SendConfdMetrics(graphiteHost, graphitePort, health)
+				reporter.Gauge("health", float64(health))
+				if err := reporter.Flush(); err != nil {
+					log.Errorln(err)
+				}
 			}
 		}()
 	}
@@ -0,0 +1,43 @@
+package graphite
+
+import (
+	"encoding/binary"
+	"github.com/marpaia/graphite-golang"
+	"math"
+	"strconv"
+)
+
+// pickle encodes metrics for the carbon pickle receiver: a length prefixed
+// protocol 2 pickle of [(name, (timestamp, value)), ...].
+func pickle(metrics []graphite.Metric) []byte {
+	b := []byte{0x80, 2, ']', '('}
+	for _, metric := range metrics {
+		b = append(b, 'X')
+		b = appendUint32(b, binary.LittleEndian, uint32(len(metric.Name)))
+		b = append(b, metric.Name...)
+		if metric.Timestamp >= math.MinInt32 && metric.Timestamp <= math.MaxInt32 {
+			b = append(b, 'J')
+			b = appendUint32(b, binary.LittleEndian, uint32(int32(metric.Timestamp)))
+		} else {
+			b = append(b, 'I')
+			b = append(b, strconv.FormatInt(metric.Timestamp, 10)...)
+			b = append(b, '\n')
+		}
+		value, err := strconv.ParseFloat(metric.Value, 64)
+		if err != nil {
+			value = math.NaN()
+		}
+		b = append(b, 'G')
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[len(b)-8:], math.Float64bits(value))
+		b = append(b, 0x86, 0x86)
+	}
+	b = append(b, 'e', '.')
+	return append(appendUint32(nil, binary.BigEndian, uint32(len(b))), b...)
+}
+
+func appendUint32(b []byte, order binary.ByteOrder, v uint32) []byte {
+	b = append(b, 0, 0, 0, 0)
+	order.PutUint32(b[len(b)-4:], v)
+	return b
+}
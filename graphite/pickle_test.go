@@ -0,0 +1,26 @@
+package graphite
+
+import (
+	"bytes"
+	"github.com/marpaia/graphite-golang"
+	"testing"
+)
+
+func TestPickle(t *testing.T) {
+	metrics := []graphite.Metric{
+		graphite.NewMetric("a.b", "1.5", 1500000000),
+		// Timestamps out of the int32 range are pickled as text.
+		graphite.NewMetric("c", "-2", 1<<40),
+	}
+	// pickle.loads(want[4:]) == [('a.b', (1500000000, 1.5)), ('c', (1099511627776, -2.0))]
+	want := []byte("\x00\x00\x00>\x80\x02](" +
+		"X\x03\x00\x00\x00a.bJ\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x86" +
+		"X\x01\x00\x00\x00cI1099511627776\nG\xc0\x00\x00\x00\x00\x00\x00\x00\x86\x86" +
+		"e.")
+	if got := pickle(metrics); !bytes.Equal(got, want) {
+		t.Errorf("pickle\n%q\nwant\n%q", got, want)
+	}
+	if got, want := pickle(nil), []byte("\x00\x00\x00\x06\x80\x02](e."); !bytes.Equal(got, want) {
+		t.Errorf("empty pickle %q, want %q", got, want)
+	}
+}
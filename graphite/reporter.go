@@ -0,0 +1,198 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"github.com/marpaia/graphite-golang"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+	minBackoff   = time.Second
+	maxBackoff   = time.Minute
+	// maxPending bounds the metrics kept while Graphite is unreachable, the
+	// oldest are dropped first.
+	maxPending = 10000
+	// udpPayload keeps the datagrams under the usual MTU.
+	udpPayload = 1400
+	// pickleBatch is the number of metrics per pickled message.
+	pickleBatch = 500
+)
+
+// Config of a Reporter. Protocol is tcp or udp, Format plaintext or pickle,
+// Prefix a template rendered once by NewReporter (see ParsePrefix).
+type Config struct {
+	Host     string
+	Port     int
+	Protocol string
+	Format   string
+	Prefix   string
+}
+
+// Reporter sends metrics to Graphite over a long-lived connection. Metrics
+// are queued by Send and written in batches by Flush, the connection is
+// redialed with an exponential backoff when it fails.
+type Reporter struct {
+	sync.Mutex
+	conf     Config
+	prefix   string
+	conn     net.Conn
+	pending  []graphite.Metric
+	backoff  time.Duration
+	retryAt  time.Time
+	failures int64
+	dropped  int64
+}
+
+// NewReporter returns a reporter, the connection is dialed by the first
+// Flush.
+func NewReporter(conf Config) (*Reporter, error) {
+	if conf.Protocol == "" {
+		conf.Protocol = "tcp"
+	}
+	if conf.Format == "" {
+		conf.Format = "plaintext"
+	}
+	if conf.Host == "" || conf.Port <= 0 {
+		return nil, errors.New("graphite host and port are required !")
+	}
+	if conf.Protocol != "tcp" && conf.Protocol != "udp" {
+		return nil, fmt.Errorf("invalid graphite protocol %q !", conf.Protocol)
+	}
+	if conf.Format != "plaintext" && conf.Format != "pickle" {
+		return nil, fmt.Errorf("invalid graphite format %q !", conf.Format)
+	}
+	if conf.Format == "pickle" && conf.Protocol != "tcp" {
+		return nil, errors.New("the graphite pickle format requires tcp !")
+	}
+	prefix, err := ParsePrefix(conf.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &Reporter{conf: conf, prefix: prefix}, nil
+}
+
+// Send queues a metric, name is relative to the prefix.
+func (r *Reporter) Send(name string, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.queue(graphite.NewMetric(r.prefix+name, strconv.FormatFloat(value, 'f', -1, 64), time.Now().Unix()))
+}
+
+func (r *Reporter) queue(metric graphite.Metric) {
+	if len(r.pending) >= maxPending {
+		r.pending = r.pending[1:]
+		r.dropped++
+	}
+	r.pending = append(r.pending, metric)
+}
+
+// Flush writes the queued metrics. On failure they are kept for the next
+// Flush and the failure is counted.
+func (r *Reporter) Flush() error {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.pending) == 0 {
+		return nil
+	}
+	if err := r.connect(); err != nil {
+		r.failures++
+		return err
+	}
+	batch := r.pending
+	if r.failures > 0 || r.dropped > 0 {
+		// The failures so far are reported along with the batch.
+		now := time.Now().Unix()
+		batch = append(batch[:len(batch):len(batch)],
+			graphite.NewMetric(r.prefix+"graphite.failures", strconv.FormatInt(r.failures, 10), now),
+			graphite.NewMetric(r.prefix+"graphite.dropped", strconv.FormatInt(r.dropped, 10), now))
+	}
+	for _, payload := range r.encode(batch) {
+		r.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := r.conn.Write(payload); err != nil {
+			r.failures++
+			r.conn.Close()
+			r.conn = nil
+			r.delay()
+			return err
+		}
+	}
+	r.pending = r.pending[:0]
+	r.backoff = 0
+	return nil
+}
+
+// connect dials Graphite unless connected or still backing off.
+func (r *Reporter) connect() error {
+	if r.conn != nil {
+		return nil
+	}
+	if now := time.Now(); now.Before(r.retryAt) {
+		return fmt.Errorf("graphite unreachable, retrying in %v !", r.retryAt.Sub(now))
+	}
+	conn, err := net.DialTimeout(r.conf.Protocol, net.JoinHostPort(r.conf.Host, strconv.Itoa(r.conf.Port)), dialTimeout)
+	if err != nil {
+		r.delay()
+		return err
+	}
+	r.conn = conn
+	return nil
+}
+
+func (r *Reporter) delay() {
+	if r.backoff == 0 {
+		r.backoff = minBackoff
+	} else if r.backoff *= 2; r.backoff > maxBackoff {
+		r.backoff = maxBackoff
+	}
+	r.retryAt = time.Now().Add(r.backoff)
+}
+
+// encode splits a batch into the payloads to write.
+func (r *Reporter) encode(batch []graphite.Metric) [][]byte {
+	var payloads [][]byte
+	if r.conf.Format == "pickle" {
+		for start := 0; start < len(batch); start += pickleBatch {
+			end := start + pickleBatch
+			if end > len(batch) {
+				end = len(batch)
+			}
+			payloads = append(payloads, pickle(batch[start:end]))
+		}
+		return payloads
+	}
+	var payload []byte
+	for _, metric := range batch {
+		line := metric.Name + " " + metric.Value + " " + strconv.FormatInt(metric.Timestamp, 10) + "\n"
+		if r.conf.Protocol == "udp" && len(payload) > 0 && len(payload)+len(line) > udpPayload {
+			payloads = append(payloads, payload)
+			payload = nil
+		}
+		payload = append(payload, line...)
+	}
+	return append(payloads, payload)
+}
+
+// Failures returns the number of failed flushes.
+func (r *Reporter) Failures() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.failures
+}
+
+// Close flushes the queued metrics and closes the connection.
+func (r *Reporter) Close() error {
+	err := r.Flush()
+	r.Lock()
+	defer r.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/marpaia/graphite-golang"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReporterEncode(t *testing.T) {
+	var batch []graphite.Metric
+	for i := 0; i < 2*pickleBatch+1; i++ {
+		batch = append(batch, graphite.NewMetric(fmt.Sprintf("webrouter.openresty.metric%04d", i), "1", 1500000000))
+	}
+
+	r := &Reporter{conf: Config{Protocol: "tcp", Format: "pickle"}}
+	want := [][]byte{pickle(batch[:pickleBatch]), pickle(batch[pickleBatch : 2*pickleBatch]), pickle(batch[2*pickleBatch:])}
+	if got := r.encode(batch); !reflect.DeepEqual(got, want) {
+		t.Errorf("pickle: %d payloads, want %d", len(got), len(want))
+	}
+
+	var lines []byte
+	for _, metric := range batch {
+		lines = append(lines, metric.Name+" 1 1500000000\n"...)
+	}
+	r = &Reporter{conf: Config{Protocol: "tcp", Format: "plaintext"}}
+	if got := r.encode(batch); len(got) != 1 || !bytes.Equal(got[0], lines) {
+		t.Errorf("tcp: %d payloads, want all the lines in one", len(got))
+	}
+	r = &Reporter{conf: Config{Protocol: "udp", Format: "plaintext"}}
+	payloads := r.encode(batch)
+	if len(payloads) < 2 {
+		t.Errorf("udp: %d payloads, want several", len(payloads))
+	}
+	for _, payload := range payloads {
+		if len(payload) > udpPayload || !bytes.HasSuffix(payload, []byte("\n")) {
+			t.Errorf("udp: payload of %d bytes not ending a line", len(payload))
+		}
+	}
+	if got := bytes.Join(payloads, nil); !bytes.Equal(got, lines) {
+		t.Errorf("udp: payloads do not add up to the lines")
+	}
+}
+
+func TestReporterPending(t *testing.T) {
+	r := &Reporter{}
+	for i := 0; i < maxPending+2; i++ {
+		r.Send(strconv.Itoa(i), 1)
+	}
+	if len(r.pending) != maxPending || r.dropped != 2 || r.pending[0].Name != "2" {
+		t.Errorf("%d pending from %s, %d dropped, want %d from 2, 2 dropped", len(r.pending), r.pending[0].Name, r.dropped, maxPending)
+	}
+}
+
+// serve accepts the connections of l and sends the name and value of the
+// lines they carry to the returned channel.
+func serve(l net.Listener) <-chan string {
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fields := strings.Fields(scanner.Text())
+					lines <- strings.Join(fields[:2], " ")
+				}
+			}()
+		}
+	}()
+	return lines
+}
+
+func receive(t *testing.T, lines <-chan string, want ...string) {
+	var got []string
+	for range want {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+func TestReporterReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	r, err := NewReporter(Config{Host: "127.0.0.1", Port: port, Prefix: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Send("a", 1)
+	if err := r.Flush(); err == nil {
+		t.Fatal("flushed without graphite")
+	}
+	if err := r.Flush(); err == nil || !strings.Contains(err.Error(), "retrying") {
+		t.Errorf("flush while backing off: %v", err)
+	}
+	if r.Failures() != 2 || r.backoff != minBackoff || len(r.pending) != 1 {
+		t.Errorf("%d failures, backoff %v, %d pending after the dial failed", r.Failures(), r.backoff, len(r.pending))
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := serve(l)
+	r.retryAt = time.Time{}
+	if err := r.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, lines, "test.a 1", "test.graphite.failures 2", "test.graphite.dropped 0")
+	if r.backoff != 0 || len(r.pending) != 0 {
+		t.Errorf("backoff %v, %d pending after a flush", r.backoff, len(r.pending))
+	}
+
+	// A broken connection keeps the metrics and is redialed.
+	r.conn.Close()
+	r.Send("b", 2.5)
+	if err := r.Flush(); err == nil {
+		t.Fatal("flushed over a closed connection")
+	}
+	if r.Failures() != 3 || r.conn != nil || len(r.pending) != 1 {
+		t.Errorf("%d failures, connection %v, %d pending after the write failed", r.Failures(), r.conn, len(r.pending))
+	}
+	r.retryAt = time.Time{}
+	r.Send("c", 3)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, lines, "test.b 2.5", "test.c 3", "test.graphite.failures 3", "test.graphite.dropped 0")
+}
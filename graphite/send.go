@@ -1,29 +1,54 @@
 package graphite
 
 import (
-	"github.com/marpaia/graphite-golang"
+	"bytes"
 	"os"
-	"strconv"
 	"strings"
+	"text/template"
 )
 
-func send(host string, port int, key string, value string) error {
-	gh, err := graphite.NewGraphite(host, port)
+const (
+	// OpenRestyPrefix is the default prefix of the watcher metrics.
+	OpenRestyPrefix = `{{ env "LAIN_DOMAIN" | dots }}.webrouter.openresty.{{ env "DEPLOYD_POD_INSTANCE_NO" }}`
+	// ConfdPrefix is the default prefix of the confd metrics.
+	ConfdPrefix = `{{ env "LAIN_DOMAIN" | dots }}.webrouter.confd`
+)
+
+var prefixFuncs = template.FuncMap{
+	"env":  os.Getenv,
+	"key":  KeyPart,
+	"dots": func(s string) string { return strings.Replace(s, ".", "_", -1) },
+}
+
+// ParsePrefix renders a prefix template. The template can read environment
+// variables with env and escape them with key, or dots which only replaces
+// the dots. A trailing dot is added to non empty prefixes.
+func ParsePrefix(text string) (string, error) {
+	tmpl, err := template.New("prefix").Funcs(prefixFuncs).Parse(text)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if err := gh.SimpleSend(key, value); err != nil {
-		return err
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, nil); err != nil {
+		return "", err
 	}
-	return nil
-}
-
-func SendOpenRestyMetrics(host string, port int, health int) error {
-	key := strings.Replace(os.Getenv("LAIN_DOMAIN"), ".", "_", -1) + ".webrouter.openresty." + os.Getenv("DEPLOYD_POD_INSTANCE_NO") + ".health"
-	return send(host, port, key, strconv.Itoa(health))
+	prefix := strings.TrimSpace(b.String())
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return prefix, nil
 }
 
-func SendConfdMetrics(host string, port int, health int) error {
-	key := strings.Replace(os.Getenv("LAIN_DOMAIN"), ".", "_", -1) + ".webrouter.confd.health"
-	return send(host, port, key, strconv.Itoa(health))
+// KeyPart turns s into a single Graphite key component.
+func KeyPart(s string) string {
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return "root"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
 }
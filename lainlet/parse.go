@@ -0,0 +1,535 @@
+package lainlet
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/laincloud/webrouter/nginx"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Shadow declares, on a shadow proc, a mountpoint whose requests are
+// mirrored to it and the percentage of them, 100 by default.
+type Shadow struct {
+	MountPoint string `json:"mountpoint"`
+	Percentage int    `json:"percentage"`
+}
+
+// Annotation is the webrouter annotation of a proc. Options needing a later
+// nginx than NGINX_VERSION, the one of the release image by default, are
+// dropped with a warning: backend_protocol grpc and grpcs need 1.13.10,
+// mirror 1.13.4 and stream tls passthrough 1.11.5.
+type Annotation struct {
+	MountPoint      []string                     `json:"mountpoint"`
+	HttpsOnly       bool                         `json:"https_only"`
+	HealthCheck     string                       `json:"healthcheck"`
+	ClientAuth      nginx.ClientAuth             `json:"client_auth"`
+	BackendProtocol string                       `json:"backend_protocol"`
+	BackendTLS      nginx.BackendTLS             `json:"backend_tls"`
+	Stream          []nginx.Stream               `json:"stream"`
+	LocationMatch   string                       `json:"location_match"`
+	KeepPrefix      bool                         `json:"keep_prefix"`
+	ReplacePrefix   string                       `json:"replace_prefix"`
+	BarePath        string                       `json:"bare_path"`
+	ServerAliases   map[string]nginx.Aliases     `json:"server_aliases"`
+	Limit           nginx.Limit                  `json:"limit"`
+	Access          nginx.Access                 `json:"access"`
+	ServerAccess    map[string]nginx.Access      `json:"server_access"`
+	BasicAuth       nginx.BasicAuth              `json:"basic_auth"`
+	AuthRequest     nginx.AuthRequest            `json:"auth_request"`
+	Headers         nginx.Headers                `json:"headers"`
+	CORS            nginx.CORS                   `json:"cors"`
+	Redirects       []nginx.Redirect             `json:"redirects"`
+	Maintenance     nginx.Maintenance            `json:"maintenance"`
+	ErrorPages      map[string]map[string]string `json:"error_pages"`
+	Mirror          []Shadow                     `json:"mirror"`
+	LoadBalance     nginx.Balance                `json:"load_balance"`
+	Cache           nginx.Cache                  `json:"cache"`
+	Ports           map[string]int               `json:"ports"`
+	MountPointPorts map[string]string            `json:"mountpoint_ports"`
+}
+
+// Routing is the routing model of a webprocs payload. Warnings report what
+// was skipped or ignored and Errors the conflicts between procs, of which the
+// config keeps the first declaration.
+type Routing struct {
+	Config   nginx.Config
+	Warnings []error
+	Errors   []error
+}
+
+func (r *Routing) warn(err error) {
+	r.Warnings = append(r.Warnings, err)
+}
+
+func (r *Routing) fail(err error) {
+	r.Errors = append(r.Errors, err)
+}
+
+// Parse builds the routing model of a webprocs payload, keyed by proc name
+// like appname.proctype.procname. Procs with an invalid annotation are
+// skipped with a warning. Conflicts between procs are all reported, the
+// config then keeps the first declaration in the order of the proc names.
+func Parse(data map[string]CoreInfoForWebrouter) Routing {
+	var r Routing
+	config := &r.Config
+	config.Servers = make(map[string]nginx.Server)
+	config.Upstreams = make(map[string]nginx.Upstream)
+	config.Streams = make(map[string]nginx.StreamServer)
+	shadows := make(map[string][]Shadow)
+	var keys []string
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := data[k]
+		s := strings.Split(k, ".")
+		if len(s) != 3 {
+			continue
+		}
+		if len(v.PodInfos) < 1 {
+			continue
+		}
+		name := strings.Replace(k, ".", "_", -1)
+		annotation := new(Annotation)
+		if v.PodInfos[0].Annotation != "" {
+			if err := json.Unmarshal([]byte(v.PodInfos[0].Annotation), annotation); err != nil {
+				r.warn(errors.New("upstream: " + name + " invalid annotation, proc skipped: " + err.Error()))
+				continue
+			}
+		}
+		if err := validateUpstream(name); err != nil {
+			r.warn(errors.New(err.Error() + " proc skipped"))
+			continue
+		}
+		if err := validateAnnotation(annotation); err != nil {
+			r.warn(errors.New("upstream: " + name + " invalid annotation, proc skipped: " + err.Error()))
+			continue
+		}
+		if len(annotation.Mirror) > 0 {
+			shadows[name] = annotation.Mirror
+		} else if !strings.HasSuffix(s[2], "_canary") {
+			for _, mountPoint := range annotation.MountPoint {
+				serverName, uri := splitMountPoint(mountPoint)
+				if _, ok := config.Servers[serverName]; !ok {
+					config.Servers[serverName] = nginx.Server{
+						Locations: make(map[string]nginx.Location),
+					}
+				}
+				location := nginx.Location{
+					Proc:            k,
+					App:             s[0],
+					Upstream:        portUpstream(name, annotation.MountPointPorts[mountPoint]),
+					HttpsOnly:       annotation.HttpsOnly,
+					ClientAuth:      annotation.ClientAuth,
+					BackendProtocol: annotation.BackendProtocol,
+					BackendTLS:      annotation.BackendTLS,
+					Match:           annotation.LocationMatch,
+					Path:            uri,
+					KeepPrefix:      annotation.KeepPrefix,
+					ReplacePrefix:   annotation.ReplacePrefix,
+					BarePath:        annotation.BarePath,
+					Limit:           annotation.Limit,
+					Access:          annotation.Access,
+					BasicAuth:       annotation.BasicAuth,
+					AuthRequest:     annotation.AuthRequest,
+					Headers:         annotation.Headers,
+					CORS:            annotation.CORS,
+					Redirects:       annotation.Redirects,
+					Maintenance:     annotation.Maintenance,
+					Cache:           annotation.Cache,
+				}
+				locations := []nginx.Location{location}
+				if location.BarePath != "" && location.Path != "/" && location.Match != "exact" && location.Match != "regex" {
+					bare := location
+					bare.Match = "exact"
+					bare.SlashRedirect = location.BarePath == "redirect"
+					locations = append(locations, bare)
+				}
+				for _, location := range locations {
+					key := nginx.LocationKey(location.Match, location.Path)
+					if config.Servers[serverName].Locations[key].Upstream != "" {
+						r.fail(errors.New("servername: " + serverName + " location: " + key +
+							" upstream1: " + config.Servers[serverName].Locations[key].Upstream +
+							" upstream2: " + location.Upstream + " duplicate location !"))
+						continue
+					}
+					config.Servers[serverName].Locations[key] = location
+				}
+			}
+			for serverName, aliases := range annotation.ServerAliases {
+				server, ok := config.Servers[serverName]
+				if !ok || !mounts(server, k) {
+					r.warn(errors.New("upstream: " + name + " declares aliases of servername: " + serverName + " it is not mounted on !"))
+					continue
+				}
+				if len(server.Aliases) > 0 && server.RedirectAliases != aliases.Redirect {
+					r.fail(errors.New("servername: " + serverName + " upstream: " + name + " conflicting alias redirect !"))
+					continue
+				}
+				server.Aliases = append(server.Aliases, aliases.Names...)
+				server.RedirectAliases = aliases.Redirect
+				config.Servers[serverName] = server
+			}
+			for serverName, access := range annotation.ServerAccess {
+				server, ok := config.Servers[serverName]
+				if !ok || !mounts(server, k) {
+					r.warn(errors.New("upstream: " + name + " declares access of servername: " + serverName + " it is not mounted on !"))
+					continue
+				}
+				server.Access.Allow = append(server.Access.Allow, access.Allow...)
+				server.Access.Deny = append(server.Access.Deny, access.Deny...)
+				config.Servers[serverName] = server
+			}
+			for serverName, pages := range annotation.ErrorPages {
+				server, ok := config.Servers[serverName]
+				if !ok || !mounts(server, k) {
+					r.warn(errors.New("upstream: " + name + " declares error pages of servername: " + serverName + " it is not mounted on !"))
+					continue
+				}
+				if server.ErrorPages == nil {
+					server.ErrorPages = make(map[string]string)
+				}
+				for code, page := range pages {
+					if other, ok := server.ErrorPages[code]; ok && other != page {
+						r.fail(errors.New("servername: " + serverName + " upstream: " + name + " conflicting error page " + code + " !"))
+						continue
+					}
+					server.ErrorPages[code] = page
+				}
+				config.Servers[serverName] = server
+			}
+			for _, stream := range annotation.Stream {
+				if stream.Protocol == "" {
+					stream.Protocol = "tcp"
+				}
+				target := portUpstream(name, stream.TargetPort)
+				key := stream.Protocol + "_" + strconv.Itoa(stream.Port)
+				server, ok := config.Streams[key]
+				if !ok {
+					server = nginx.StreamServer{
+						Port:       stream.Port,
+						Protocol:   stream.Protocol,
+						TLS:        stream.TLS,
+						ServerName: stream.ServerName,
+					}
+					if stream.TLS == "passthrough" {
+						server.SNI = map[string]string{stream.ServerName: target}
+					} else {
+						server.Upstream = target
+					}
+					config.Streams[key] = server
+					continue
+				}
+				upstream := server.Upstream
+				if server.TLS == "passthrough" && stream.TLS == "passthrough" {
+					if upstream, ok = server.SNI[stream.ServerName]; !ok {
+						server.SNI[stream.ServerName] = target
+						continue
+					}
+				}
+				if upstream == "" {
+					for _, upstream = range server.SNI {
+						break
+					}
+				}
+				r.fail(errors.New("stream port: " + strconv.Itoa(stream.Port) + " protocol: " + stream.Protocol +
+					" upstream1: " + upstream + " upstream2: " + target + " duplicate stream port !"))
+			}
+		}
+		// The upstream of the proc proxies to the exposed port of the
+		// containers, those of the named ports of its mountpoints and streams
+		// to the declared ports.
+		ports := map[string]int{name: 0}
+		for _, port := range annotation.MountPointPorts {
+			ports[portUpstream(name, port)] = annotation.Ports[port]
+		}
+		for _, stream := range annotation.Stream {
+			ports[portUpstream(name, stream.TargetPort)] = annotation.Ports[stream.TargetPort]
+		}
+		servers := make(map[string][]string)
+		for _, pod := range v.PodInfos {
+			podServers, err := serversOf(pod, ports)
+			if err != nil {
+				r.warn(errors.New("upstream: " + name + " pod: " + strconv.Itoa(pod.InstanceNo) + " skipped: " + err.Error()))
+				continue
+			}
+			for upstream, addrs := range podServers {
+				servers[upstream] = append(servers[upstream], addrs...)
+			}
+		}
+		var upstreams []string
+		for upstream := range ports {
+			upstreams = append(upstreams, upstream)
+		}
+		sort.Strings(upstreams)
+		for _, upstream := range upstreams {
+			if _, ok := config.Upstreams[upstream]; ok {
+				r.fail(errors.New("upstream: " + upstream + " proc: " + k + " duplicate upstream !"))
+				continue
+			}
+			addrs := unique(servers[upstream])
+			if len(addrs) == 0 {
+				r.warn(errors.New("upstream: " + upstream + " has no servers, serving maintenance !"))
+				addrs = append(addrs, "127.0.0.1:11111")
+				for _, server := range config.Servers {
+					for key, location := range server.Locations {
+						if location.Upstream == upstream {
+							location.Maintenance.Enabled = true
+							server.Locations[key] = location
+						}
+					}
+				}
+			}
+			config.Upstreams[upstream] = nginx.Upstream{
+				Proc:        k,
+				App:         s[0],
+				HealthCheck: annotation.HealthCheck,
+				Protocol:    annotation.BackendProtocol,
+				Balance:     annotation.LoadBalance,
+				Servers:     addrs,
+			}
+		}
+	}
+	addMirrors(&r, shadows)
+	checkServerNames(&r)
+	checkAuthProcs(&r)
+	checkOverlap(&r)
+	return r
+}
+
+// checkOverlap reports regex locations that shadow a prefix location of
+// another upstream, as nginx checks regex locations before prefix ones.
+// Patterns Go cannot compile (PCRE only syntax) are not checked.
+func checkOverlap(r *Routing) {
+	config := &r.Config
+	for _, serverName := range serverNames(config) {
+		server := config.Servers[serverName]
+		for _, regexKey := range locationKeys(server) {
+			regexLocation := server.Locations[regexKey]
+			if regexLocation.Match != "regex" {
+				continue
+			}
+			re, err := regexp.Compile("^/" + regexLocation.Path)
+			if err != nil {
+				r.warn(errors.New("servername: " + serverName + " location: " + regexKey + " cannot be checked for overlaps: " + err.Error() + " !"))
+				continue
+			}
+			for _, key := range locationKeys(server) {
+				location := server.Locations[key]
+				if location.Match == "exact" || location.Match == "regex" || location.Proc == regexLocation.Proc {
+					continue
+				}
+				if re.MatchString(location.Pattern()) {
+					r.fail(errors.New("servername: " + serverName + " location: " + regexKey +
+						" upstream1: " + regexLocation.Upstream + " shadows location: " + key +
+						" upstream2: " + location.Upstream + " overlapping location !"))
+				}
+			}
+		}
+	}
+}
+
+// addMirrors adds the shadow procs to the locations they mirror, in the
+// order of their upstream names so that the config does not change between
+// two identical payloads.
+func addMirrors(r *Routing, shadows map[string][]Shadow) {
+	config := &r.Config
+	var names []string
+	for name := range shadows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, shadow := range shadows[name] {
+			serverName, uri := splitMountPoint(shadow.MountPoint)
+			percentage := shadow.Percentage
+			if percentage == 0 {
+				percentage = 100
+			}
+			mirrored := false
+			for key, location := range config.Servers[serverName].Locations {
+				if location.Path != uri || location.SlashRedirect || location.Upstream == name {
+					continue
+				}
+				location.Mirrors = append(location.Mirrors, nginx.Mirror{
+					Upstream:   name,
+					Percentage: percentage,
+				})
+				config.Servers[serverName].Locations[key] = location
+				mirrored = true
+			}
+			if !mirrored {
+				r.warn(errors.New("upstream: " + name + " mirrors mountpoint: " + shadow.MountPoint + " which is not mounted !"))
+			}
+		}
+	}
+}
+
+// portUpstream returns the upstream of a named port of the proc upstream,
+// which is the proc upstream itself without a port name. The canary suffix
+// stays last so that AB testing pairs the upstreams of the same port.
+func portUpstream(upstream, port string) string {
+	if port == "" {
+		return upstream
+	}
+	if strings.HasSuffix(upstream, "_canary") {
+		return strings.TrimSuffix(upstream, "_canary") + "__" + port + "_canary"
+	}
+	return upstream + "__" + port
+}
+
+// serversOf returns the servers of a pod for each upstream of its proc, with
+// the port of ports or, if 0, the exposed port of the containers. Containers
+// without an IP or exposing no port, like sidecars, are left out and a pod
+// without any other container is an error.
+func serversOf(pod PodInfoForWebrouter, ports map[string]int) (map[string][]string, error) {
+	servers := make(map[string][]string)
+	addressed := false
+	for _, container := range pod.Containers {
+		if container.IP == "" {
+			continue
+		}
+		addressed = true
+		if net.ParseIP(container.IP) == nil {
+			return nil, errors.New("container ip: " + container.IP + " is invalid !")
+		}
+		if container.Expose < 0 || container.Expose > 65535 {
+			return nil, errors.New("container ip: " + container.IP + " expose: " + strconv.Itoa(container.Expose) + " is invalid !")
+		}
+		if container.Expose == 0 {
+			continue
+		}
+		for upstream, port := range ports {
+			if port == 0 {
+				port = container.Expose
+			}
+			servers[upstream] = append(servers[upstream], net.JoinHostPort(container.IP, strconv.Itoa(port)))
+		}
+	}
+	if !addressed {
+		return nil, errors.New("no container has an ip !")
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no container exposes a port !")
+	}
+	return servers, nil
+}
+
+func unique(addrs []string) []string {
+	sort.Strings(addrs)
+	var uniq []string
+	for i, addr := range addrs {
+		if i == 0 || addr != addrs[i-1] {
+			uniq = append(uniq, addr)
+		}
+	}
+	return uniq
+}
+
+// mounts reports whether proc has a location on server.
+func mounts(server nginx.Server, proc string) bool {
+	for _, location := range server.Locations {
+		if location.Proc == proc {
+			return true
+		}
+	}
+	return false
+}
+
+// checkServerNames reports server names declared by more than one server,
+// which nginx would ignore with a "conflicting server name" warning, and
+// alias redirects towards a server name that is not a plain host. Exact names
+// overlapping with a wildcard name of another server are resolved by nginx in
+// favour of the exact name and are only warned about.
+func checkServerNames(r *Routing) {
+	config := &r.Config
+	owners := make(map[string]string)
+	for _, serverName := range serverNames(config) {
+		server := config.Servers[serverName]
+		if server.RedirectAliases && !isExactServerName(serverName) {
+			r.fail(errors.New("servername: " + serverName + " aliases can only redirect to an exact server name !"))
+		}
+		for _, name := range append([]string{serverName}, server.Aliases...) {
+			if owner, ok := owners[name]; ok {
+				r.fail(errors.New("servername: " + name + " server1: " + owner + " server2: " + serverName + " duplicate server name !"))
+				continue
+			}
+			owners[name] = serverName
+		}
+	}
+	var names, exact []string
+	for name := range owners {
+		names = append(names, name)
+		if isExactServerName(name) {
+			exact = append(exact, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(exact)
+	for _, name := range names {
+		owner := owners[name]
+		if isExactServerName(name) {
+			continue
+		}
+		var suffix string
+		if strings.HasPrefix(name, "*.") {
+			suffix = name[1:]
+		} else if strings.HasPrefix(name, ".") {
+			suffix = name
+		} else {
+			continue
+		}
+		for _, other := range exact {
+			if owners[other] != owner && (strings.HasSuffix(other, suffix) || "."+other == suffix) {
+				r.warn(errors.New("servername: " + other + " wildcard: " + name + " exact server name takes precedence over wildcard server name of " + owner + " !"))
+			}
+		}
+	}
+}
+
+// isExactServerName reports whether name is neither a wildcard nor a regex
+// server name.
+func isExactServerName(name string) bool {
+	return !strings.HasPrefix(name, "~") && !strings.HasPrefix(name, ".") && !strings.Contains(name, "*")
+}
+
+// checkAuthProcs reports auth_request procs missing from the snapshot.
+func checkAuthProcs(r *Routing) {
+	config := &r.Config
+	for _, serverName := range serverNames(config) {
+		server := config.Servers[serverName]
+		for _, uri := range locationKeys(server) {
+			location := server.Locations[uri]
+			if location.AuthRequest.Proc == "" {
+				continue
+			}
+			if _, ok := config.Upstreams[strings.Replace(location.AuthRequest.Proc, ".", "_", -1)]; !ok {
+				r.fail(errors.New("servername: " + serverName + " location: " + uri +
+					" auth_request proc: " + location.AuthRequest.Proc + " does not exist !"))
+			}
+		}
+	}
+}
+
+func serverNames(config *nginx.Config) []string {
+	var names []string
+	for serverName := range config.Servers {
+		names = append(names, serverName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func locationKeys(server nginx.Server) []string {
+	var keys []string
+	for key := range server.Locations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
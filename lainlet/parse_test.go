@@ -0,0 +1,218 @@
+package lainlet
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/laincloud/webrouter/nginx"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func loadFixture(t *testing.T, name string) map[string]CoreInfoForWebrouter {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]CoreInfoForWebrouter
+	if err := json.Unmarshal(b, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// summary describes the routing of config in sorted lines.
+func summary(config nginx.Config) []string {
+	var lines []string
+	for serverName, server := range config.Servers {
+		if len(server.Aliases) > 0 {
+			line := "aliases " + serverName + " " + strings.Join(server.Aliases, " ")
+			if server.RedirectAliases {
+				line += " redirect"
+			}
+			lines = append(lines, line)
+		}
+		for key, location := range server.Locations {
+			line := "location " + serverName + " " + key + " " + location.Upstream
+			for _, mirror := range location.Mirrors {
+				line += fmt.Sprintf(" mirror %s %d%%", mirror.Upstream, mirror.Percentage)
+			}
+			if location.Maintenance.Enabled {
+				line += " maintenance"
+			}
+			lines = append(lines, line)
+		}
+	}
+	for name, upstream := range config.Upstreams {
+		lines = append(lines, "upstream "+name+" "+strings.Join(upstream.Servers, " "))
+	}
+	for key, stream := range config.Streams {
+		lines = append(lines, "stream "+key+" "+stream.Upstream+" "+config.Upstreams[stream.Upstream].Proc)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func messages(errs []error) []string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		summary  []string
+		warnings []string
+		errors   []string
+	}{
+		{
+			fixture: "webprocs.json",
+			summary: []string{
+				"aliases hello.example.com www.hello.example.com redirect",
+				"location console.example.com / console_web_web",
+				"location console.example.com =login passport_web_web",
+				"location hello.example.com / hello_web_web",
+				"location hello.example.com api hello_web_web mirror hello_web_shadow 10%",
+				"stream tcp_2222 console_web_web console.web.web",
+				"upstream console_web_web 172.20.1.2:8000",
+				"upstream hello_web_shadow 172.20.0.14:8080",
+				"upstream hello_web_web 172.20.0.11:8080 172.20.0.12:8080",
+				"upstream hello_web_web_canary 172.20.0.13:8080",
+				"upstream passport_web_web 172.20.1.3:8080",
+			},
+		},
+		{
+			fixture: "conflicts.json",
+			summary: []string{
+				"aliases x.example.com b.example.com",
+				"location a.example.com / a_web_web",
+				"location a.example.com api a_web_web",
+				"location a.example.com ~ap. e_web_web",
+				"location b.example.com / c_web_web",
+				"location d.example.com / d_web_web",
+				"location x.example.com / b_web_web",
+				"stream tcp_2222 c_web_web c.web.web",
+				"upstream a_web_web 172.20.2.1:8080",
+				"upstream b_web_web 172.20.2.2:8080",
+				"upstream c_web_web 172.20.2.3:8080",
+				"upstream d_web_web 172.20.2.4:8080",
+				"upstream e_web_web 172.20.2.5:8080",
+			},
+			errors: []string{
+				"servername: a.example.com location: api upstream1: a_web_web upstream2: b_web_web duplicate location !",
+				"stream port: 2222 protocol: tcp upstream1: c_web_web upstream2: d_web_web duplicate stream port !",
+				"servername: b.example.com server1: b.example.com server2: x.example.com duplicate server name !",
+				"servername: d.example.com location: / auth_request proc: auth.web.web does not exist !",
+				"servername: a.example.com location: ~ap. upstream1: e_web_web shadows location: api upstream2: a_web_web overlapping location !",
+			},
+		},
+		{
+			fixture: "invalid.json",
+			summary: []string{
+				"location c.example.com / c_web_web maintenance",
+				"location d.example.com / d_web_web",
+				"location f.example.com / f_web_web",
+				"upstream c_web_web 127.0.0.1:11111",
+				"upstream d_web_web 172.20.3.4:8080",
+				"upstream e_web_shadow 172.20.3.6:8080",
+				"upstream f_web_web 172.20.3.7:8080",
+			},
+			warnings: []string{
+				"upstream: a_web_web invalid annotation, proc skipped: unexpected end of JSON input",
+				"upstream: b_web_web invalid annotation, proc skipped: limit rate: lots must be like 10r/s or 60r/m !",
+				"upstream: c_web_web pod: 1 skipped: no container has an ip !",
+				"upstream: c_web_web has no servers, serving maintenance !",
+				"upstream: d_web_web pod: 2 skipped: container ip: 172.20.3.5 expose: 70000 is invalid !",
+				"upstream: f_web_web declares aliases of servername: g.example.com it is not mounted on !",
+				"upstream: e_web_shadow mirrors mountpoint: e.example.com which is not mounted !",
+			},
+		},
+		{
+			fixture: "ports.json",
+			summary: []string{
+				"location admin.example.com / shop_web_web__admin",
+				"location api.example.com / shop_worker_api__grpc",
+				"location shop.example.com / shop_web_web",
+				"location shop.example.com admin shop_web_web__admin",
+				"stream tcp_6379 shop_worker_api__redis shop.worker.api",
+				"upstream shop_web_web 172.20.4.1:8080 172.20.4.3:8080",
+				"upstream shop_web_web__admin 172.20.4.1:9090 172.20.4.3:9090",
+				"upstream shop_web_web__admin_canary 172.20.4.9:9090",
+				"upstream shop_web_web_canary 172.20.4.9:8080",
+				"upstream shop_worker_api 172.20.5.1:8000",
+				"upstream shop_worker_api__grpc 172.20.5.1:50051",
+				"upstream shop_worker_api__redis 172.20.5.1:6379",
+			},
+			warnings: []string{
+				"upstream: shop_web_web pod: 3 skipped: no container has an ip !",
+				"upstream: shop_web_web pod: 4 skipped: no container has an ip !",
+				"upstream: shop_web_web pod: 5 skipped: container ip: 172.20.4.x is invalid !",
+				"upstream: shop_web_web pod: 6 skipped: no container exposes a port !",
+				"upstream: shop_worker_bad invalid annotation, proc skipped: mountpoint_ports mountpoint: bad.example.com port: http is not declared in ports !",
+				"upstream: shop_worker_ssh invalid annotation, proc skipped: stream port: 2222 target_port: ssh is not declared in ports !",
+			},
+			errors: []string{
+				"upstream: shop_web_web__admin proc: shop.web.web__admin duplicate upstream !",
+			},
+		},
+	}
+	for _, test := range tests {
+		routing := Parse(loadFixture(t, test.fixture))
+		if got := summary(routing.Config); !reflect.DeepEqual(got, test.summary) {
+			t.Errorf("%s: config\n%s\nwant\n%s", test.fixture, strings.Join(got, "\n"), strings.Join(test.summary, "\n"))
+		}
+		if got := messages(routing.Warnings); !reflect.DeepEqual(got, test.warnings) {
+			t.Errorf("%s: warnings\n%s\nwant\n%s", test.fixture, strings.Join(got, "\n"), strings.Join(test.warnings, "\n"))
+		}
+		if got := messages(routing.Errors); !reflect.DeepEqual(got, test.errors) {
+			t.Errorf("%s: errors\n%s\nwant\n%s", test.fixture, strings.Join(got, "\n"), strings.Join(test.errors, "\n"))
+		}
+	}
+}
+
+// TestParseDeterministic checks that the same payload always gives the same
+// routing, so that the watcher does not reload nginx for nothing.
+func TestParseDeterministic(t *testing.T) {
+	for _, fixture := range []string{"webprocs.json", "conflicts.json", "invalid.json", "ports.json"} {
+		data := loadFixture(t, fixture)
+		first := Parse(data)
+		for i := 0; i < 20; i++ {
+			if routing := Parse(data); !reflect.DeepEqual(routing, first) {
+				t.Fatalf("%s: routing changed between two parses", fixture)
+			}
+		}
+	}
+}
+
+func TestCheckServerNames(t *testing.T) {
+	location := map[string]nginx.Location{"/": {Path: "/"}}
+	r := Routing{Config: nginx.Config{Servers: map[string]nginx.Server{
+		"*.a.org":   {Locations: location},
+		"www.a.org": {Locations: location},
+		".b.org":    {Locations: location},
+		"b.org":     {Aliases: []string{"b.net"}, RedirectAliases: true, Locations: location},
+		"*.c.org":   {Aliases: []string{"c.net"}, RedirectAliases: true, Locations: location},
+		"d.org":     {Aliases: []string{"b.net", "*.a.org"}, Locations: location},
+	}}}
+	checkServerNames(&r)
+	warnings := []string{
+		"servername: www.a.org wildcard: *.a.org exact server name takes precedence over wildcard server name of *.a.org !",
+		"servername: b.org wildcard: .b.org exact server name takes precedence over wildcard server name of .b.org !",
+	}
+	if got := messages(r.Warnings); !reflect.DeepEqual(got, warnings) {
+		t.Errorf("warnings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(warnings, "\n"))
+	}
+	errors := []string{
+		"servername: *.c.org aliases can only redirect to an exact server name !",
+		"servername: b.net server1: b.org server2: d.org duplicate server name !",
+		"servername: *.a.org server1: *.a.org server2: d.org duplicate server name !",
+	}
+	if got := messages(r.Errors); !reflect.DeepEqual(got, errors) {
+		t.Errorf("errors\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(errors, "\n"))
+	}
+}
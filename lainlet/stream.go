@@ -0,0 +1,103 @@
+package lainlet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+type ContainerForWebrouter struct {
+	IP     string `json:"ContainerIp"`
+	Expose int
+}
+
+type PodInfoForWebrouter struct {
+	Annotation string
+	Containers []ContainerForWebrouter `json:"ContainerInfos"`
+	InstanceNo int
+}
+
+type CoreInfoForWebrouter struct {
+	PodInfos []PodInfoForWebrouter
+}
+
+type WebrouterInfo struct {
+	Data map[string]CoreInfoForWebrouter
+}
+
+// Payload is a webprocs payload sent by lainlet, or the error receiving it.
+type Payload struct {
+	Data map[string]CoreInfoForWebrouter
+	Err  error
+}
+
+// Stream reads the payloads of a webprocs event stream.
+type Stream struct {
+	reader *bufio.Reader
+	err    error
+}
+
+func NewStream(r io.Reader) *Stream {
+	return &Stream{reader: bufio.NewReader(r)}
+}
+
+// Next returns the payload of the next data line. The payload Err is set
+// when it cannot be decoded and the stream goes on. The error returned is
+// the read error ending the stream, io.EOF at its end.
+func (s *Stream) Next() (Payload, error) {
+	for s.err == nil {
+		var line []byte
+		line, s.err = s.reader.ReadBytes('\n')
+		fields := bytes.SplitN(bytes.TrimSpace(line), []byte{':'}, 2)
+		if len(fields) < 2 || string(bytes.TrimSpace(fields[0])) != "data" {
+			continue
+		}
+		value := bytes.TrimSpace(fields[1])
+		if len(value) == 0 {
+			continue
+		}
+		var payload Payload
+		payload.Err = json.Unmarshal(value, &payload.Data)
+		return payload, nil
+	}
+	return Payload{}, s.err
+}
+
+// Watch watches the webprocs of lainlet, reconnecting a second after the
+// connection fails or ends. Errors are sent as payloads with Err set.
+func Watch(addr string) <-chan Payload {
+	payloadCh := make(chan Payload)
+	go func() {
+		for {
+			watch(addr, payloadCh)
+			time.Sleep(time.Second)
+		}
+	}()
+	return payloadCh
+}
+
+func watch(addr string, payloadCh chan<- Payload) {
+	resp, err := http.Get("http://" + addr + "/v2/webrouter/webprocs?watch=1")
+	if err != nil {
+		payloadCh <- Payload{Err: err}
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		payloadCh <- Payload{Err: errors.New("lainlet: " + addr + " watch failed: " + resp.Status + " !")}
+		return
+	}
+	stream := NewStream(resp.Body)
+	for {
+		payload, err := stream.Next()
+		if err != nil {
+			payloadCh <- Payload{Err: err}
+			return
+		}
+		payloadCh <- payload
+	}
+}
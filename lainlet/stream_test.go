@@ -0,0 +1,104 @@
+package lainlet
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// failingReader returns its data then err.
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+// describe describes a payload as its procs and their pod counts, or its
+// decoding error.
+func describe(payload Payload) string {
+	if payload.Err != nil {
+		return "error"
+	}
+	var procs []string
+	for name, proc := range payload.Data {
+		procs = append(procs, name+":"+strconv.Itoa(len(proc.PodInfos)))
+	}
+	sort.Strings(procs)
+	return strings.Join(procs, " ")
+}
+
+func TestStream(t *testing.T) {
+	fixture, err := os.Open("testdata/watch.sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixture.Close()
+	broken := errors.New("connection reset")
+	tests := []struct {
+		name     string
+		input    io.Reader
+		payloads []string
+		err      error
+	}{
+		{
+			name:     "watch.sse",
+			input:    fixture,
+			payloads: []string{"hello.web.web:2", "error", "hello.web.web:1"},
+			err:      io.EOF,
+		},
+		{
+			name:     "no trailing newline",
+			input:    strings.NewReader(`data: {"a.web.web": {"PodInfos": []}}`),
+			payloads: []string{"a.web.web:0"},
+			err:      io.EOF,
+		},
+		{
+			name:  "empty",
+			input: strings.NewReader(""),
+			err:   io.EOF,
+		},
+		{
+			name:  "comments and empty data",
+			input: strings.NewReader(": ping\nevent: heartbeat\ndata:\n\n"),
+			err:   io.EOF,
+		},
+		{
+			name:     "read error",
+			input:    &failingReader{strings.NewReader("data: {}\n\ndata: {\"a.web"), broken},
+			payloads: []string{"", "error"},
+			err:      broken,
+		},
+	}
+	for _, test := range tests {
+		stream := NewStream(test.input)
+		var payloads []string
+		for {
+			payload, err := stream.Next()
+			if err != nil {
+				if err != test.err {
+					t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+				}
+				break
+			}
+			payloads = append(payloads, describe(payload))
+		}
+		if !reflect.DeepEqual(payloads, test.payloads) {
+			t.Errorf("%s: payloads %q, want %q", test.name, payloads, test.payloads)
+		}
+		if _, err := stream.Next(); err != test.err {
+			t.Errorf("%s: error after the end %v, want %v", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package lainlet
+
+import (
+	"errors"
+	"github.com/laincloud/webrouter/nginx"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	hostnameRegexp   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+	pathRegexp       = regexp.MustCompile(`^[A-Za-z0-9._~%!*+,=:@-]+(/[A-Za-z0-9._~%!*+,=:@-]+)*$`)
+	uriRegexp        = regexp.MustCompile(`^/[A-Za-z0-9._~%!*+,=:@/?&-]*$`)
+	fileRegexp       = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+	upstreamRegexp   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	portNameRegexp   = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	procRegexp       = regexp.MustCompile(`^[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+$`)
+	unsafeRegexp     = regexp.MustCompile(`["'\s]|\\$`)
+	unsafeNameRegexp = regexp.MustCompile(`["'\s;{}]|\\$`)
+)
+
+// splitMountPoint splits a mountpoint like "example.com/api/" into its server
+// name and location, which is "/" for the root and has no slashes around it
+// otherwise.
+func splitMountPoint(mountPoint string) (string, string) {
+	mountPoint = strings.TrimSuffix(mountPoint, "/")
+	if i := strings.Index(mountPoint, "/"); i > 0 {
+		return mountPoint[:i], mountPoint[i+1:]
+	}
+	return mountPoint, "/"
+}
+
+// validServerName reports whether name is a hostname, a wildcard name like
+// "*.example.com", ".example.com" or "www.example.*", or a regex name
+// starting with "~" that cannot break out of the server_name directive.
+func validServerName(name string) bool {
+	switch {
+	case strings.HasPrefix(name, "~"):
+		return len(name) > 1 && !unsafeNameRegexp.MatchString(name)
+	case strings.HasPrefix(name, "*."):
+		return hostnameRegexp.MatchString(name[2:])
+	case strings.HasPrefix(name, "."):
+		return hostnameRegexp.MatchString(name[1:])
+	case strings.HasSuffix(name, ".*"):
+		return hostnameRegexp.MatchString(name[:len(name)-2])
+	}
+	return hostnameRegexp.MatchString(name)
+}
+
+// validFile reports whether name can be used as a file name in the SSL or
+// htpasswd paths.
+func validFile(name string) bool {
+	return name == "" || (fileRegexp.MatchString(name) && !strings.Contains(name, ".."))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUpstream checks the upstream name derived from a proc name.
+func validateUpstream(name string) error {
+	if !upstreamRegexp.MatchString(name) {
+		return errors.New("upstream: " + name + " contains invalid characters !")
+	}
+	return nil
+}
+
+// validateAnnotation checks every annotation value ending up in the nginx
+// config, so that a proc cannot inject directives into it.
+func validateAnnotation(annotation *Annotation) error {
+	for _, mountPoint := range annotation.MountPoint {
+		if strings.TrimSuffix(mountPoint, "/") == "" {
+			return errors.New("mountpoint is empty !")
+		}
+		serverName, uri := splitMountPoint(mountPoint)
+		if !validServerName(serverName) {
+			return errors.New("mountpoint: " + mountPoint + " servername: " + serverName + " is invalid !")
+		}
+		if uri == "/" {
+			continue
+		}
+		if annotation.LocationMatch == "regex" {
+			if unsafeRegexp.MatchString(uri) {
+				return errors.New("mountpoint: " + mountPoint + " regex: " + uri + " contains unsafe characters !")
+			}
+		} else if !pathRegexp.MatchString(uri) {
+			return errors.New("mountpoint: " + mountPoint + " location: " + uri + " is invalid !")
+		}
+	}
+	for name, port := range annotation.Ports {
+		if !portNameRegexp.MatchString(name) {
+			return errors.New("port name: " + name + " is invalid !")
+		}
+		if port < 1 || port > 65535 {
+			return errors.New("port: " + name + " " + strconv.Itoa(port) + " must be between 1 and 65535 !")
+		}
+	}
+	for mountPoint, port := range annotation.MountPointPorts {
+		if !contains(annotation.MountPoint, mountPoint) {
+			return errors.New("mountpoint_ports mountpoint: " + mountPoint + " is not a mountpoint of the proc !")
+		}
+		if _, ok := annotation.Ports[port]; !ok {
+			return errors.New("mountpoint_ports mountpoint: " + mountPoint + " port: " + port + " is not declared in ports !")
+		}
+	}
+	for _, shadow := range annotation.Mirror {
+		serverName, uri := splitMountPoint(shadow.MountPoint)
+		if !validServerName(serverName) || (uri != "/" && !pathRegexp.MatchString(uri)) {
+			return errors.New("mirror mountpoint: " + shadow.MountPoint + " is invalid !")
+		}
+		if shadow.Percentage < 0 || shadow.Percentage > 100 {
+			return errors.New("mirror mountpoint: " + shadow.MountPoint + " percentage must be between 0 and 100 !")
+		}
+	}
+	if annotation.HealthCheck != "" && !uriRegexp.MatchString(annotation.HealthCheck) {
+		return errors.New("healthcheck: " + annotation.HealthCheck + " is invalid !")
+	}
+	if annotation.ReplacePrefix != "" && annotation.ReplacePrefix != "/" &&
+		!(strings.HasPrefix(annotation.ReplacePrefix, "/") && pathRegexp.MatchString(strings.Trim(annotation.ReplacePrefix, "/"))) {
+		return errors.New("replace_prefix: " + annotation.ReplacePrefix + " is invalid !")
+	}
+	for _, file := range []string{annotation.ClientAuth.CA, annotation.BackendTLS.CA, annotation.BackendTLS.Cert, annotation.BasicAuth.File} {
+		if !validFile(file) {
+			return errors.New("file: " + file + " is invalid !")
+		}
+	}
+	if annotation.BackendTLS.ServerName != "" && !hostnameRegexp.MatchString(annotation.BackendTLS.ServerName) {
+		return errors.New("backend_tls server_name: " + annotation.BackendTLS.ServerName + " is invalid !")
+	}
+	if strings.ContainsAny(annotation.BasicAuth.Realm, "\"\\\r\n") {
+		return errors.New("basic_auth realm: " + annotation.BasicAuth.Realm + " contains unsafe characters !")
+	}
+	if annotation.AuthRequest.Proc != "" {
+		if !procRegexp.MatchString(annotation.AuthRequest.Proc) {
+			return errors.New("auth_request proc: " + annotation.AuthRequest.Proc + " is invalid !")
+		}
+		if !uriRegexp.MatchString(annotation.AuthRequest.URI) {
+			return errors.New("auth_request uri: " + annotation.AuthRequest.URI + " is invalid !")
+		}
+	}
+	location := nginx.Location{
+		ClientAuth:      annotation.ClientAuth,
+		BackendProtocol: annotation.BackendProtocol,
+		BackendTLS:      annotation.BackendTLS,
+		Match:           annotation.LocationMatch,
+		KeepPrefix:      annotation.KeepPrefix,
+		ReplacePrefix:   annotation.ReplacePrefix,
+		BarePath:        annotation.BarePath,
+		Limit:           annotation.Limit,
+		AuthRequest:     annotation.AuthRequest,
+		Headers:         annotation.Headers,
+		CORS:            annotation.CORS,
+		Redirects:       annotation.Redirects,
+		Maintenance:     annotation.Maintenance,
+		Cache:           annotation.Cache,
+	}
+	if err := location.Validate(); err != nil {
+		return err
+	}
+	if err := annotation.LoadBalance.Validate(); err != nil {
+		return err
+	}
+	for _, stream := range annotation.Stream {
+		if err := stream.Validate(); err != nil {
+			return err
+		}
+		if stream.ServerName != "" && !hostnameRegexp.MatchString(stream.ServerName) {
+			return errors.New("stream server_name: " + stream.ServerName + " is invalid !")
+		}
+		if _, ok := annotation.Ports[stream.TargetPort]; stream.TargetPort != "" && !ok {
+			return errors.New("stream port: " + strconv.Itoa(stream.Port) + " target_port: " + stream.TargetPort + " is not declared in ports !")
+		}
+	}
+	for _, pages := range annotation.ErrorPages {
+		if err := nginx.ValidateErrorPages(pages); err != nil {
+			return err
+		}
+	}
+	for serverName, aliases := range annotation.ServerAliases {
+		for _, name := range append([]string{serverName}, aliases.Names...) {
+			if !validServerName(name) {
+				return errors.New("server_aliases: " + name + " is invalid !")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package lainlet
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWatchConfigConflicts checks that a payload with conflicts is still
+// sent, keeping the first declaration of each conflict.
+func TestWatchConfigConflicts(t *testing.T) {
+	data, err := json.Marshal(loadFixture(t, "conflicts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/webrouter/webprocs" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("id: 1\nevent: init\ndata: " + string(data) + "\n\n"))
+	}))
+	defer server.Close()
+
+	select {
+	case config := <-WatchConfig(strings.TrimPrefix(server.URL, "http://")):
+		if config.Err != nil {
+			t.Fatal(config.Err)
+		}
+		if got := config.Servers["a.example.com"].Locations["api"].Upstream; got != "a_web_web" {
+			t.Errorf("location api of a.example.com proxied to %q, want a_web_web", got)
+		}
+		if got := config.Servers["d.example.com"].Locations["/"].Upstream; got != "d_web_web" {
+			t.Errorf("location / of d.example.com proxied to %q, want d_web_web", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no config sent")
+	}
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The OTLP/HTTP JSON encoding of an ExportMetricsServiceRequest, reduced to
+// gauges with string attributes.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name  string    `json:"name"`
+		Gauge otlpGauge `json:"gauge"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpDataPoint struct {
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		TimeUnixNano string          `json:"timeUnixNano"`
+		AsDouble     float64         `json:"asDouble"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// otlp posts the gauges to an OpenTelemetry collector, named
+// webrouter.<component>.<name>. Tags of the config become resource
+// attributes, along with service.name.
+type otlp struct {
+	sync.Mutex
+	endpoint string
+	client   *http.Client
+	prefix   string
+	resource otlpResource
+	metrics  []otlpMetric
+	index    map[string]int
+	points   int
+	failures int64
+}
+
+func newOTLP(conf Config) (*otlp, error) {
+	if conf.OTLPEndpoint == "" {
+		return nil, errors.New("otlp endpoint is required !")
+	}
+	o := &otlp{
+		endpoint: conf.OTLPEndpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		prefix:   "webrouter." + conf.Component + ".",
+		index:    make(map[string]int),
+	}
+	o.resource.Attributes = append(o.resource.Attributes, otlpAttribute{Key: "service.name", Value: otlpValue{"webrouter-" + conf.Component}})
+	o.resource.Attributes = append(o.resource.Attributes, attributes(conf.Tags)...)
+	return o, nil
+}
+
+func attributes(tags []Tag) []otlpAttribute {
+	var attrs []otlpAttribute
+	for _, tag := range tags {
+		attrs = append(attrs, otlpAttribute{Key: tag.Key, Value: otlpValue{tag.Value}})
+	}
+	return attrs
+}
+
+func (o *otlp) Gauge(name string, value float64, tags ...Tag) {
+	o.Lock()
+	defer o.Unlock()
+	o.gauge(name, value, tags)
+}
+
+func (o *otlp) gauge(name string, value float64, tags []Tag) {
+	if o.points >= maxPending {
+		return
+	}
+	o.points++
+	i, ok := o.index[name]
+	if !ok {
+		i = len(o.metrics)
+		o.index[name] = i
+		o.metrics = append(o.metrics, otlpMetric{Name: o.prefix + name})
+	}
+	o.metrics[i].Gauge.DataPoints = append(o.metrics[i].Gauge.DataPoints, otlpDataPoint{
+		Attributes:   attributes(tags),
+		TimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		AsDouble:     value,
+	})
+}
+
+// Flush posts the queued gauges in one request, they are dropped if it fails
+// and the failure is counted in the metrics.failures gauge.
+func (o *otlp) Flush() error {
+	o.Lock()
+	defer o.Unlock()
+	if len(o.metrics) == 0 {
+		return nil
+	}
+	if o.failures > 0 {
+		o.points = 0
+		o.gauge("metrics.failures", float64(o.failures), nil)
+	}
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     o.resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "github.com/laincloud/webrouter"}, Metrics: o.metrics}},
+	}}})
+	o.metrics = nil
+	o.index = make(map[string]int)
+	o.points = 0
+	if err != nil {
+		o.failures++
+		return err
+	}
+	resp, err := o.client.Post(o.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		o.failures++
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		o.failures++
+		return fmt.Errorf("otlp export failed: %s !", resp.Status)
+	}
+	return nil
+}
+
+func (o *otlp) Close() error {
+	return o.Flush()
+}
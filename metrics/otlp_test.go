@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestOTLPGauge(t *testing.T) {
+	var requests []otlpRequest
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpRequest
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s request of %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, request)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	reporter, err := New(Config{
+		Reporter:     "otlp",
+		Component:    "confd",
+		Tags:         []Tag{{"lain_domain", "lain.local"}},
+		OTLPEndpoint: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.Gauge("health", 1)
+	reporter.Gauge("access.requests", 2, Tag{"server", "a.org"})
+	reporter.Gauge("access.requests", 3, Tag{"server", "b.org"})
+	status = http.StatusInternalServerError
+	if err := reporter.Flush(); err == nil {
+		t.Error("flushed to a failing collector")
+	}
+	status = http.StatusOK
+	reporter.Gauge("health", 1)
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	point := func(value float64, tags ...Tag) otlpDataPoint {
+		return otlpDataPoint{Attributes: attributes(tags), AsDouble: value}
+	}
+	want := [][]otlpMetric{
+		{
+			{Name: "webrouter.confd.health", Gauge: otlpGauge{[]otlpDataPoint{point(1)}}},
+			{Name: "webrouter.confd.access.requests", Gauge: otlpGauge{[]otlpDataPoint{point(2, Tag{"server", "a.org"}), point(3, Tag{"server", "b.org"})}}},
+		},
+		{
+			{Name: "webrouter.confd.health", Gauge: otlpGauge{[]otlpDataPoint{point(1)}}},
+			{Name: "webrouter.confd.metrics.failures", Gauge: otlpGauge{[]otlpDataPoint{point(1)}}},
+		},
+	}
+	resource := otlpResource{Attributes: []otlpAttribute{
+		{Key: "service.name", Value: otlpValue{"webrouter-confd"}},
+		{Key: "lain_domain", Value: otlpValue{"lain.local"}},
+	}}
+	if len(requests) != len(want) {
+		t.Fatalf("%d requests, want %d", len(requests), len(want))
+	}
+	for i, request := range requests {
+		if len(request.ResourceMetrics) != 1 || len(request.ResourceMetrics[0].ScopeMetrics) != 1 {
+			t.Fatalf("request %d: %+v", i, request)
+		}
+		if got := request.ResourceMetrics[0].Resource; !reflect.DeepEqual(got, resource) {
+			t.Errorf("request %d: resource %+v, want %+v", i, got, resource)
+		}
+		metrics := request.ResourceMetrics[0].ScopeMetrics[0].Metrics
+		for _, metric := range metrics {
+			for j := range metric.Gauge.DataPoints {
+				if metric.Gauge.DataPoints[j].TimeUnixNano == "" {
+					t.Errorf("request %d: %s has no time", i, metric.Name)
+				}
+				metric.Gauge.DataPoints[j].TimeUnixNano = ""
+			}
+		}
+		if !reflect.DeepEqual(metrics, want[i]) {
+			t.Errorf("request %d: metrics\n%+v\nwant\n%+v", i, metrics, want[i])
+		}
+	}
+}
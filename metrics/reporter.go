@@ -0,0 +1,89 @@
+// Package metrics reports the webrouter gauges to Graphite, StatsD or an
+// OpenTelemetry collector.
+package metrics
+
+import (
+	"fmt"
+	"github.com/laincloud/webrouter/graphite"
+	"strings"
+)
+
+// maxPending bounds the gauges queued between two flushes.
+const maxPending = 10000
+
+// Tag is a dimension of a gauge.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Reporter is implemented by the exporters. Gauges are queued and sent by
+// Flush, the names are dotted and relative to the component.
+type Reporter interface {
+	Gauge(name string, value float64, tags ...Tag)
+	Flush() error
+	Close() error
+}
+
+// Config selects and configures the exporter. Component is openresty or
+// confd, Tags are added to every gauge by StatsD and OTLP.
+type Config struct {
+	Reporter     string
+	Component    string
+	Tags         []Tag
+	Graphite     graphite.Config
+	StatsDAddr   string
+	OTLPEndpoint string
+}
+
+// New returns the reporter named by conf.Reporter: graphite, statsd or otlp.
+func New(conf Config) (Reporter, error) {
+	switch conf.Reporter {
+	case "graphite":
+		reporter, err := graphite.NewReporter(conf.Graphite)
+		if err != nil {
+			return nil, err
+		}
+		return graphiteReporter{reporter}, nil
+	case "statsd":
+		return newStatsD(conf)
+	case "otlp":
+		return newOTLP(conf)
+	}
+	return nil, fmt.Errorf("invalid metrics reporter %q !", conf.Reporter)
+}
+
+// ParseTags parses tags written like key:value,key:value.
+func ParseTags(s string) ([]Tag, error) {
+	var tags []Tag
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid metrics tag %q !", pair)
+		}
+		tags = append(tags, Tag{Key: kv[0], Value: kv[1]})
+	}
+	return tags, nil
+}
+
+// graphiteReporter has no tags, their values are inserted in order before
+// the last component of the name: access.requests tagged a.org, /api/ and
+// a_web_web is sent as access.a_org.api.a_web_web.requests.
+type graphiteReporter struct {
+	*graphite.Reporter
+}
+
+func (r graphiteReporter) Gauge(name string, value float64, tags ...Tag) {
+	if len(tags) > 0 {
+		parts := make([]string, len(tags))
+		for i, tag := range tags {
+			parts[i] = graphite.KeyPart(tag.Value)
+		}
+		i := strings.LastIndex(name, ".")
+		name = name[:i+1] + strings.Join(parts, ".") + "." + name[i+1:]
+	}
+	r.Send(name, value)
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bufio"
+	"github.com/laincloud/webrouter/graphite"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags(" env:prod, url:http://a.org ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Tag{{"env", "prod"}, {"url", "http://a.org"}}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags %v, want %v", tags, want)
+	}
+	for _, s := range []string{"env", ":prod"} {
+		if _, err := ParseTags(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestGraphiteGauge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	reporter, err := New(Config{
+		Reporter:  "graphite",
+		Component: "openresty",
+		Tags:      []Tag{{"lain_domain", "lain.local"}},
+		Graphite:  graphite.Config{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, Prefix: "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.Gauge("health", 1)
+	reporter.Gauge("access.requests", 3, Tag{"server", "a.org"}, Tag{"location", "/api/"}, Tag{"upstream", "a_web_web"})
+	reporter.Gauge("requests", 4, Tag{"location", "/"})
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		lines = append(lines, fields[0]+" "+fields[1])
+	}
+	// The tags of the config are not sent, Graphite has them in the prefix.
+	want := []string{
+		"test.health 1",
+		"test.access.a_org.api.a_web_web.requests 3",
+		"test.root.requests 4",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// statsdPayload keeps the datagrams under the usual MTU.
+const statsdPayload = 1400
+
+var (
+	statsdReplacer      = strings.NewReplacer("|", "_", ",", "_", "#", "_", ":", "_", "\n", "_")
+	statsdValueReplacer = strings.NewReplacer("|", "_", ",", "_", "\n", "_")
+)
+
+// statsD sends the gauges over UDP with DogStatsD tags, named
+// webrouter.<component>.<name>.
+type statsD struct {
+	sync.Mutex
+	conn     net.Conn
+	prefix   string
+	tags     []Tag
+	pending  []string
+	failures int64
+}
+
+func newStatsD(conf Config) (*statsD, error) {
+	if conf.StatsDAddr == "" {
+		return nil, errors.New("statsd address is required !")
+	}
+	// Dialing UDP only resolves the address, the socket is kept.
+	conn, err := net.Dial("udp", conf.StatsDAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsD{conn: conn, prefix: "webrouter." + conf.Component + ".", tags: conf.Tags}, nil
+}
+
+func (s *statsD) Gauge(name string, value float64, tags ...Tag) {
+	line := s.line(name, value, tags)
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pending) < maxPending {
+		s.pending = append(s.pending, line)
+	}
+}
+
+func (s *statsD) line(name string, value float64, tags []Tag) string {
+	line := statsdReplacer.Replace(s.prefix+name) + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|g"
+	all := append(s.tags[:len(s.tags):len(s.tags)], tags...)
+	for i, tag := range all {
+		if i == 0 {
+			line += "|#"
+		} else {
+			line += ","
+		}
+		line += statsdReplacer.Replace(tag.Key) + ":" + statsdValueReplacer.Replace(tag.Value)
+	}
+	return line
+}
+
+// Flush sends the queued gauges, those of a failed datagram are dropped and
+// counted in the metrics.failures gauge.
+func (s *statsD) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if s.failures > 0 {
+		s.pending = append(s.pending, s.line("metrics.failures", float64(s.failures), nil))
+	}
+	var payloads [][]byte
+	var payload []byte
+	for _, line := range s.pending {
+		if len(payload) > 0 && len(payload)+len(line)+1 > statsdPayload {
+			payloads = append(payloads, payload)
+			payload = nil
+		}
+		if len(payload) > 0 {
+			payload = append(payload, '\n')
+		}
+		payload = append(payload, line...)
+	}
+	payloads = append(payloads, payload)
+	s.pending = s.pending[:0]
+	var err error
+	for _, payload := range payloads {
+		if _, e := s.conn.Write(payload); e != nil {
+			s.failures++
+			err = e
+		}
+	}
+	return err
+}
+
+func (s *statsD) Close() error {
+	err := s.Flush()
+	s.conn.Close()
+	return err
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDGauge(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reporter, err := New(Config{
+		Reporter:   "statsd",
+		Component:  "openresty",
+		Tags:       []Tag{{"lain_domain", "lain.local"}},
+		StatsDAddr: conn.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter.Gauge("health", 1)
+	reporter.Gauge("access.requests", 2.5, Tag{"server", "a.org"}, Tag{"location", "/api/"})
+	// The separators of the format are replaced in names, keys and values.
+	reporter.Gauge("a|b:c", 3, Tag{"k#e,y", "x|y,z:w"})
+	if err := reporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, statsdPayload)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"webrouter.openresty.health:1|g|#lain_domain:lain.local",
+		"webrouter.openresty.access.requests:2.5|g|#lain_domain:lain.local,server:a.org,location:/api/",
+		"webrouter.openresty.a_b_c:3|g|#lain_domain:lain.local,k_e_y:x_y_z:w",
+	}
+	if got := string(b[:n]); got != strings.Join(want, "\n") {
+		t.Errorf("datagram\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
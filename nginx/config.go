@@ -1,39 +1,666 @@
 package nginx
 
 import (
+	"crypto/sha1"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"github.com/facebookgo/pidfile"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"text/template"
 )
 
-var nginxConfTmpl, upstreamTmpl, serverTmpl, proxyConfTmpl *template.Template
+var nginxConfTmpl, upstreamTmpl, serverTmpl, proxyConfTmpl, streamTmpl *template.Template
 var certs map[string]*x509.Certificate
+var nginxConf NginxConf
+
+// confPath is where the configs are written and offline skips the state of
+// the running nginx, both are set by Init.
+var confPath string
+var offline bool
+
+// nginxVersion is the version of the nginx the configs are rendered for, set
+// by Init. Directives of later versions are not rendered.
+var nginxVersion string
+
+// ClientAuth requires (Verify "on") or optionally checks (Verify "optional")
+// a client certificate signed by the CA bundle <SSLPath><CA>.ca.pem, through
+// at most Depth intermediate certificates, 2 when 0. The locations of a
+// server share its CA and depth.
+type ClientAuth struct {
+	Verify string `json:"verify"`
+	CA     string `json:"ca"`
+	Depth  int    `json:"depth"`
+}
+
+// BackendTLS configures the TLS connection to https and grpcs backends.
+// CA names the bundle <SSLPath><CA>.ca.pem used to verify the backend and
+// Cert names the client certificate <SSLPath><Cert>.client.pem and its key
+// <SSLPath><Cert>.client.key presented to it.
+type BackendTLS struct {
+	ServerName string `json:"server_name"`
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+}
+
+// Limit limits the request rate and the concurrent connections of a location
+// per client key, which is "ip" (the default), "header:<name>" or
+// "cookie:<name>". ZoneSize is in megabytes and requests from the Exempt CIDRs
+// are not limited. Zone is set when rendering.
+type Limit struct {
+	Rate        string   `json:"rate"`
+	Burst       int      `json:"burst"`
+	NoDelay     bool     `json:"nodelay"`
+	Connections int      `json:"connections"`
+	Key         string   `json:"key"`
+	ZoneSize    int      `json:"zone_size"`
+	Status      int      `json:"status"`
+	Exempt      []string `json:"exempt"`
+	Zone        string   `json:"-"`
+}
+
+// Variable returns the nginx variable holding the client key.
+func (l Limit) Variable() string {
+	if strings.HasPrefix(l.Key, "header:") {
+		return "$http_" + strings.ToLower(strings.Replace(l.Key[len("header:"):], "-", "_", -1))
+	}
+	if strings.HasPrefix(l.Key, "cookie:") {
+		return "$cookie_" + l.Key[len("cookie:"):]
+	}
+	return "$binary_remote_addr"
+}
+
+// KeyVariable returns the nginx variable used as the key of the limit zones,
+// which is empty for exempt clients.
+func (l Limit) KeyVariable() string {
+	if len(l.Exempt) > 0 {
+		return "$" + l.Zone + "_key"
+	}
+	return l.Variable()
+}
+
+// Size returns the size of the limit zones in megabytes. Binary addresses
+// take 64 bytes per state, so 10m keeps about 160 thousand clients; longer
+// header and cookie keys get twice as much.
+func (l Limit) Size() int {
+	if l.ZoneSize > 0 {
+		return l.ZoneSize
+	}
+	if l.Key == "" || l.Key == "ip" {
+		return 10
+	}
+	return 20
+}
+
+// Access lists the client addresses allowed or denied, as CIDRs or names of
+// the IP lists configured in RenderConf. Denies are checked first and, if any
+// address is allowed, all others are denied. Locations with access lists of
+// their own keep the denies of the server but not its allows.
+type Access struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Rules returns the allow and deny directives of the access lists.
+func (a Access) Rules() []string {
+	var rules []string
+	for _, cidr := range a.Deny {
+		rules = append(rules, "deny "+cidr)
+	}
+	for _, cidr := range a.Allow {
+		rules = append(rules, "allow "+cidr)
+	}
+	if len(a.Allow) > 0 {
+		rules = append(rules, "deny all")
+	}
+	return rules
+}
+
+// BasicAuth protects a location with HTTP basic authentication against the
+// htpasswd file <HtpasswdPath><File>.htpasswd.
+type BasicAuth struct {
+	Realm string `json:"realm"`
+	File  string `json:"file"`
+}
+
+// AuthRequest delegates the authentication of a location to URI of the lain
+// proc Proc, named like appname.proctype.procname, and copies Headers from its
+// response to the request proxied to the backend. Upstream, Scheme and
+// Location are set when rendering.
+type AuthRequest struct {
+	Proc     string   `json:"proc"`
+	URI      string   `json:"uri"`
+	Headers  []string `json:"headers"`
+	Upstream string   `json:"-"`
+	Scheme   string   `json:"-"`
+	Location string   `json:"-"`
+}
+
+// Variable returns the variable holding header of the auth response.
+func (a AuthRequest) Variable(header string) string {
+	return "$auth_" + strings.ToLower(strings.Replace(header, "-", "_", -1))
+}
+
+// Response returns the variable of header in the auth response.
+func (a AuthRequest) Response(header string) string {
+	return "$upstream_http_" + strings.ToLower(strings.Replace(header, "-", "_", -1))
+}
+
+// HeaderRules add, override or remove headers. Added request headers are
+// set like overridden ones, as the backend receives a single value anyway.
+type HeaderRules struct {
+	Add    map[string]string `json:"add"`
+	Set    map[string]string `json:"set"`
+	Remove []string          `json:"remove"`
+}
+
+func (h HeaderRules) empty() bool {
+	return len(h.Add) == 0 && len(h.Set) == 0 && len(h.Remove) == 0
+}
+
+// Headers manipulates the headers of the request proxied to the backend and
+// of the response returned to the client.
+type Headers struct {
+	Request  HeaderRules `json:"request"`
+	Response HeaderRules `json:"response"`
+}
+
+// RequestDirectives returns the directives of module, proxy or grpc, setting
+// the request headers.
+func (h Headers) RequestDirectives(module string) []string {
+	var directives []string
+	for _, name := range sortedKeys(h.Request.Add) {
+		directives = append(directives, module+"_set_header "+name+" "+quote(h.Request.Add[name]))
+	}
+	for _, name := range sortedKeys(h.Request.Set) {
+		directives = append(directives, module+"_set_header "+name+" "+quote(h.Request.Set[name]))
+	}
+	for _, name := range h.Request.Remove {
+		directives = append(directives, module+"_set_header "+name+" \"\"")
+	}
+	return directives
+}
+
+// ResponseDirectives returns the directives of module, proxy or grpc, setting
+// the response headers.
+func (h Headers) ResponseDirectives(module string) []string {
+	var directives []string
+	for _, name := range sortedKeys(h.Response.Add) {
+		directives = append(directives, "add_header "+name+" "+quote(h.Response.Add[name])+" always")
+	}
+	for _, name := range sortedKeys(h.Response.Set) {
+		directives = append(directives, module+"_hide_header "+name)
+		directives = append(directives, "add_header "+name+" "+quote(h.Response.Set[name])+" always")
+	}
+	for _, name := range h.Response.Remove {
+		directives = append(directives, module+"_hide_header "+name)
+	}
+	return directives
+}
+
+// CORS is the cross-origin resource sharing policy of a location. Origins
+// may contain "*" to allow any origin, but not with Credentials. Variable is
+// set when rendering.
+type CORS struct {
+	Origins     []string `json:"origins"`
+	Methods     []string `json:"methods"`
+	Headers     []string `json:"headers"`
+	Credentials bool     `json:"credentials"`
+	MaxAge      int      `json:"max_age"`
+	Variable    string   `json:"-"`
+}
+
+// AnyOrigin reports whether all origins are allowed.
+func (c CORS) AnyOrigin() bool {
+	for _, origin := range c.Origins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Redirect is a redirect or rewrite rule of a location, applied in order
+// before the request is proxied. Match is a regex on the whole request path
+// and Target may refer to its captures as $1, $2... A Status of 301, 302,
+// 303, 307 or 308 redirects the client to Target, which may be a path or a
+// URL on another host. Without Status the path is rewritten to Target before
+// it is passed to the upstream. The query string is dropped unless
+// PreserveQuery is set.
+type Redirect struct {
+	Match         string `json:"match"`
+	Target        string `json:"target"`
+	Status        int    `json:"status"`
+	PreserveQuery bool   `json:"preserve_query"`
+}
+
+// Pattern returns the quoted regex of the rule.
+func (r Redirect) Pattern() string {
+	return quote(r.Match)
+}
+
+// Destination returns the quoted argument of the return or rewrite directive.
+func (r Redirect) Destination() string {
+	switch {
+	case r.Status != 0 && r.PreserveQuery:
+		return quote(r.Target + "$is_args$args")
+	case r.Status == 0 && !r.PreserveQuery:
+		return quote(r.Target + "?")
+	}
+	return quote(r.Target)
+}
+
+// Maintenance is the response served instead of proxying to the upstream,
+// when an app is put under maintenance or has no backends left. Page is an
+// html file in the error page path, otherwise Body is returned as JSON.
+// Location is set when rendering.
+type Maintenance struct {
+	Enabled    bool   `json:"enabled"`
+	Page       string `json:"page"`
+	Body       string `json:"body"`
+	RetryAfter int    `json:"retry_after"`
+	Location   string `json:"-"`
+}
+
+// Retry returns the Retry-After header value in seconds.
+func (m Maintenance) Retry() int {
+	if m.RetryAfter == 0 {
+		return defaultRetryAfter
+	}
+	return m.RetryAfter
+}
+
+// Response returns the quoted JSON body of the 503 response.
+func (m Maintenance) Response() string {
+	if m.Body == "" {
+		return quote(defaultMaintenanceBody)
+	}
+	return quote(m.Body)
+}
+
+// Mirror copies a sample of the requests of a location to a shadow
+// upstream, whose responses are discarded. The shadow receives the original
+// request URI. Mirrors need nginx 1.13.4, they are dropped with a warning
+// before. Location, Scheme and Variable are set when rendering.
+type Mirror struct {
+	Upstream   string
+	Percentage int
+	Location   string
+	Scheme     string
+	Variable   string
+}
+
+// Cache caches the responses of a location in a zone of its own, with
+// ZoneSize megabytes of keys and MaxSize megabytes on disk, evicted after
+// Inactive. Valid maps statuses like "200 302" or "any" to how long they are
+// cached, like "10m". The cache key is the scheme, host and URI plus the
+// "header:<name>" and "cookie:<name>" listed in Key. Bypass lists the
+// "header:<name>", "cookie:<name>" or "arg:<name>" which skip the cache when
+// set. Stale lists when a stale response is served instead, like "error",
+// "timeout", "updating" or "http_503", and with Background expired responses
+// are served while they are refreshed. Zone and Path are set when rendering.
+type Cache struct {
+	Enabled    bool              `json:"enabled"`
+	ZoneSize   int               `json:"zone_size"`
+	MaxSize    int               `json:"max_size"`
+	Inactive   string            `json:"inactive"`
+	Valid      map[string]string `json:"valid"`
+	Key        []string          `json:"key"`
+	Bypass     []string          `json:"bypass"`
+	Stale      []string          `json:"stale"`
+	Background bool              `json:"background"`
+	Zone       string            `json:"-"`
+	Path       string            `json:"-"`
+}
+
+// Size returns the size of the keys zone in megabytes.
+func (c Cache) Size() int {
+	if c.ZoneSize > 0 {
+		return c.ZoneSize
+	}
+	return 10
+}
+
+// Max returns the maximum size of the cache on disk in megabytes.
+func (c Cache) Max() int {
+	if c.MaxSize > 0 {
+		return c.MaxSize
+	}
+	return 1024
+}
+
+// InactiveTime returns how long unused responses are kept.
+func (c Cache) InactiveTime() string {
+	if c.Inactive == "" {
+		return "10m"
+	}
+	return c.Inactive
+}
+
+// ValidDirectives returns the proxy_cache_valid directives, sorted.
+func (c Cache) ValidDirectives() []string {
+	var directives []string
+	for _, status := range sortedKeys(c.Valid) {
+		directives = append(directives, "proxy_cache_valid "+status+" "+c.Valid[status])
+	}
+	return directives
+}
+
+// KeyString returns the quoted proxy_cache_key.
+func (c Cache) KeyString() string {
+	key := "$scheme$host$request_uri"
+	for _, k := range c.Key {
+		key += ":" + cacheVariable(k)
+	}
+	return quote(key)
+}
+
+// BypassVariables returns the variables which skip the cache when set.
+func (c Cache) BypassVariables() string {
+	var variables []string
+	for _, b := range c.Bypass {
+		variables = append(variables, cacheVariable(b))
+	}
+	return strings.Join(variables, " ")
+}
+
+func cacheVariable(s string) string {
+	switch {
+	case strings.HasPrefix(s, "header:"):
+		return "$http_" + strings.ToLower(strings.Replace(s[len("header:"):], "-", "_", -1))
+	case strings.HasPrefix(s, "cookie:"):
+		return "$cookie_" + s[len("cookie:"):]
+	case strings.HasPrefix(s, "arg:"):
+		return "$arg_" + s[len("arg:"):]
+	}
+	return ""
+}
 
 type Location struct {
-	Upstream  string
-	HttpsOnly bool
-	ABTest    bool
+	Proc            string
+	App             string
+	Upstream        string
+	HttpsOnly       bool
+	ABTest          bool
+	ClientAuth      ClientAuth
+	BackendProtocol string
+	BackendTLS      BackendTLS
+	Match           string
+	Path            string
+	KeepPrefix      bool
+	ReplacePrefix   string
+	BarePath        string
+	SlashRedirect   bool
+	Limit           Limit
+	Access          Access
+	BasicAuth       BasicAuth
+	AuthRequest     AuthRequest
+	Headers         Headers
+	CORS            CORS
+	Redirects       []Redirect
+	Maintenance     Maintenance
+	Mirrors         []Mirror
+	Affinity        string
+	Cache           Cache
+}
+
+// ProxyHeaders reports whether the location sets proxy headers of its own,
+// which requires including proxy.conf again as proxy_set_header directives
+// are only inherited from the server when a location has none.
+func (l Location) ProxyHeaders(tls bool) bool {
+	return (tls && l.ClientAuth.Verify != "") || len(l.AuthRequest.Headers) > 0 || !l.Headers.Request.empty()
+}
+
+// ResponseHeaders reports whether the location adds response headers of its
+// own, which drops the add_header directives inherited from the server.
+func (l Location) ResponseHeaders() bool {
+	return len(l.Headers.Response.Add) > 0 || len(l.Headers.Response.Set) > 0 || l.CORS.Variable != "" || l.Affinity != ""
+}
+
+// LocationKey returns the key of a location in Server.Locations. Prefix
+// locations are keyed by their path as is, exact and regex ones by the path
+// prefixed with "=" and "~" so that they never collide with prefix ones.
+func LocationKey(match, path string) string {
+	switch match {
+	case "exact":
+		return "=" + path
+	case "regex":
+		return "~" + path
+	}
+	return path
+}
+
+// Pattern returns the argument of the location directive.
+func (l Location) Pattern() string {
+	switch l.Match {
+	case "exact":
+		if l.Path == "/" {
+			return "= /"
+		}
+		return "= /" + l.Path
+	case "regex":
+		return "~ \"^/" + l.Path + "\""
+	}
+	if l.Path == "/" {
+		return "/"
+	}
+	return "/" + l.Path + "/"
+}
+
+// LogLocation returns the quoted location logged in JSON access logs, with
+// the dollar signs of regex locations escaped through a variable.
+func (l Location) LogLocation() string {
+	location := l.Pattern()
+	if l.Match == "regex" {
+		location = "~ ^/" + l.Path
+	}
+	return quote(strings.Replace(location, "$", "${webrouter_dollar}", -1))
+}
+
+// Rewrite returns the arguments of the rewrite directive which strips the
+// matched prefix or replaces it with ReplacePrefix, or "" if the URI is
+// passed to the backend unchanged.
+func (l Location) Rewrite() string {
+	if l.KeepPrefix {
+		return ""
+	}
+	replace := l.ReplacePrefix
+	if replace == "" {
+		if l.Path == "/" {
+			return ""
+		}
+		replace = "/"
+	}
+	switch l.Match {
+	case "exact":
+		return "^ " + replace
+	case "regex":
+		return "\"^/(?:" + l.Path + ")/?(?<webrouter_path>.*)$\" " + replace + "$webrouter_path"
+	}
+	if l.Path == "/" {
+		return "/(.*) " + replace + "$1"
+	}
+	return "/" + l.Path + "/(.*) " + replace + "$1"
+}
+
+// Scheme returns the scheme used in the proxy_pass or grpc_pass directive.
+func (l Location) Scheme() string {
+	if l.BackendProtocol == "" {
+		return "http"
+	}
+	return l.BackendProtocol
+}
+
+// GRPC reports whether the location is proxied with grpc_pass.
+func (l Location) GRPC() bool {
+	return l.BackendProtocol == "grpc" || l.BackendProtocol == "grpcs"
+}
+
+// Module returns the nginx module prefix of the location's proxy directives.
+func (l Location) Module() string {
+	if l.GRPC() {
+		return "grpc"
+	}
+	return "proxy"
+}
+
+// Aliases are further server names of a server. With Redirect they are
+// redirected to the server's primary name instead of sharing its locations.
+type Aliases struct {
+	Names    []string `json:"names"`
+	Redirect bool     `json:"redirect"`
 }
 
 type Server struct {
-	SSL       string
-	Locations map[string]Location
+	SSL             string
+	ClientCA        string
+	ClientDepth     int
+	HTTP2           bool
+	Aliases         []string
+	RedirectAliases bool
+	Access          Access
+	ErrorPages      map[string]string
+	Locations       map[string]Location
 }
 
+// ErrorCodes returns the status codes with a custom error page, sorted.
+func (s Server) ErrorCodes() []string {
+	return sortedKeys(s.ErrorPages)
+}
+
+// Balance is the load balancing method of an upstream: "round_robin" (the
+// default), "least_conn", "ip_hash", "hash" on Key, which is "uri",
+// "header:<name>" or "cookie:<name>", or "cookie" affinity. Affinity pins a
+// client to a server with a consistent hash on the Cookie set on its first
+// response, kept for MaxAge seconds or the browser session.
+type Balance struct {
+	Method     string `json:"method"`
+	Key        string `json:"key"`
+	Consistent bool   `json:"consistent"`
+	Cookie     string `json:"cookie"`
+	MaxAge     int    `json:"max_age"`
+}
+
+// Directive returns the load balancing directive of the upstream named name,
+// which is empty for round robin.
+func (b Balance) Directive(name string) string {
+	switch b.Method {
+	case "least_conn", "ip_hash":
+		return b.Method
+	case "hash":
+		variable := "$request_uri"
+		if strings.HasPrefix(b.Key, "header:") {
+			variable = "$http_" + strings.ToLower(strings.Replace(b.Key[len("header:"):], "-", "_", -1))
+		} else if strings.HasPrefix(b.Key, "cookie:") {
+			variable = "$cookie_" + b.Key[len("cookie:"):]
+		}
+		if b.Consistent {
+			return "hash " + variable + " consistent"
+		}
+		return "hash " + variable
+	case "cookie":
+		return "hash " + b.Variable(name) + " consistent"
+	}
+	return ""
+}
+
+// UpsyncLB returns the upsync_lb method matching the load balancing method,
+// so that upsync rebuilds the right peers when servers change.
+func (b Balance) UpsyncLB() string {
+	switch b.Method {
+	case "least_conn", "ip_hash":
+		return b.Method
+	case "hash":
+		if b.Consistent {
+			return "hash_ketama"
+		}
+		return "hash_modula"
+	case "cookie":
+		return "hash_ketama"
+	}
+	return ""
+}
+
+// CookieName returns the name of the affinity cookie.
+func (b Balance) CookieName() string {
+	if b.Cookie == "" {
+		return defaultAffinityCookie
+	}
+	return b.Cookie
+}
+
+// Variable returns the variable holding the affinity key of the upstream
+// named name: the affinity cookie, or the request id when it is not set yet.
+func (b Balance) Variable(name string) string {
+	return "$affinity_" + name
+}
+
+// SetCookie returns the variable holding the Set-Cookie header of the
+// upstream named name, which is empty when the client has the cookie.
+func (b Balance) SetCookie(name string) string {
+	return "$affinity_" + name + "_set_cookie"
+}
+
+// CookieAttributes returns the attributes of the affinity cookie.
+func (b Balance) CookieAttributes() string {
+	if b.MaxAge > 0 {
+		return "; Path=/; Max-Age=" + strconv.Itoa(b.MaxAge) + "; HttpOnly"
+	}
+	return "; Path=/; HttpOnly"
+}
+
+// Upstream is the upstream of a proc, or of one of its ports. Proc and App
+// name the lain proc, like appname.proctype.procname and appname.
 type Upstream struct {
+	Proc        string
+	App         string
 	HealthCheck string
+	Protocol    string
+	Balance     Balance
 	Servers     []string
 }
 
+// Stream declares a TCP or UDP port proxied to a proc. TLS is empty for plain
+// proxying, "terminate" to terminate TLS with the certificate covering
+// ServerName, or "passthrough" to route by SNI ServerName without decrypting.
+// TargetPort names the port of the proc proxied to, the exposed port of its
+// containers by default. Unlike the http upstreams, the servers of the
+// stream upstreams are not synced by upsync: they are written in stream.conf
+// and nginx is reloaded when they change, at most once per
+// STREAM_RELOAD_INTERVAL seconds when nothing else changed.
+type Stream struct {
+	Port       int    `json:"port"`
+	Protocol   string `json:"protocol"`
+	TLS        string `json:"tls"`
+	ServerName string `json:"server_name"`
+	TargetPort string `json:"target_port"`
+}
+
+// StreamServer is a server in the stream {} block. Passthrough servers route
+// to the upstream in SNI by the client's server name, all others to Upstream.
+type StreamServer struct {
+	Port       int
+	Protocol   string
+	TLS        string
+	ServerName string
+	SSL        string
+	Upstream   string
+	SNI        map[string]string
+}
+
 type Config struct {
 	Servers   map[string]Server
 	Upstreams map[string]Upstream
+	Streams   map[string]StreamServer
 	Err       error
 }
 
@@ -49,8 +676,18 @@ type RedisConf struct {
 	KeepaliveTimeout int
 }
 
+// InitConf configures Init. TmplPath and ConfPath default to the tmpl and
+// conf directories of NginxPath. Offline renders the configs only: the lock
+// file, the upstreams, log and cache directories of the running nginx are
+// not created, the htpasswd, CA and page files are not checked and a missing
+// SSL directory leaves no certificates. NginxVersion is the version of the
+// nginx running the configs, the one of the release image by default.
 type InitConf struct {
 	NginxPath                 string
+	NginxVersion              string
+	TmplPath                  string
+	ConfPath                  string
+	Offline                   bool
 	LogPath                   string
 	ServerName                string
 	PidPath                   string
@@ -59,6 +696,12 @@ type InitConf struct {
 	ServerNamesHashMaxSize    int
 	ServerNamesHashBucketSize int
 	CheckShmSize              int
+	RealIPFrom                []string
+	LogFormat                 string
+	RequestIDHeader           string
+	RequestIDTrust            string
+	Tracing                   string
+	TraceSampleRatio          float64
 	ABTest                    bool
 	RedisConf                 RedisConf
 }
@@ -71,33 +714,68 @@ type NginxConf struct {
 	ServerNamesHashMaxSize    int
 	ServerNamesHashBucketSize int
 	CheckShmSize              int
+	RealIPFrom                []string
+	LogFormat                 string
+	RequestIDHeader           string
+	RequestIDTrust            string
+	Tracing                   string
+	TraceSampleRatio          float64
 	ABTest                    bool
 	RedisConf                 RedisConf
+	Caches                    []Cache
+	Streams                   bool
+	StreamLog                 bool
+	JSONEscape                bool
+}
+
+// RequestIDVariable returns the variable holding the incoming request id.
+func (c NginxConf) RequestIDVariable() string {
+	return "$http_" + strings.ToLower(strings.Replace(c.RequestIDHeader, "-", "_", -1))
+}
+
+// TraceSamplePercent returns the share of the generated traces which are
+// sampled, as a split_clients percentage.
+func (c NginxConf) TraceSamplePercent() string {
+	return strconv.FormatFloat(c.TraceSampleRatio*100, 'f', -1, 64) + "%"
 }
 
 type ProxyConf struct {
-	NginxPath string
-	ABTest    bool
-	RedisConf RedisConf
+	NginxPath       string
+	RequestIDHeader string
+	Tracing         bool
+	ABTest          bool
+	RedisConf       RedisConf
 }
 
 type RenderConf struct {
-	NginxPath    string
-	LogPath      string
-	HTTPS        bool
-	SSLPath      string
-	ConsulAddr   string
-	ConsulPrefix string
-	ABTest       bool
-	RedisConf    RedisConf
+	NginxPath     string
+	LogPath       string
+	HTTPS         bool
+	SSLPath       string
+	ConsulAddr    string
+	ConsulPrefix  string
+	IPLists       map[string][]string
+	HtpasswdPath  string
+	ErrorPagePath string
+	CachePath     string
+	LogFormat     string
+	NoLocationLog bool
+	ABTest        bool
+	RedisConf     RedisConf
 }
 
 type ServerConf struct {
-	NginxPath string
-	LogPath   string
-	HTTPS     bool
-	SSLPath   string
-	ABTest    bool
+	NginxPath       string
+	LogPath         string
+	HTTPS           bool
+	SSLPath         string
+	HtpasswdPath    string
+	ErrorPagePath   string
+	LogFormat       string
+	NoLocationLog   bool
+	RequestIDHeader string
+	Tracing         bool
+	ABTest          bool
 }
 
 type UpstreamConf struct {
@@ -106,34 +784,168 @@ type UpstreamConf struct {
 	ConsulPrefix string
 }
 
+type StreamConf struct {
+	LogPath string
+	SSLPath string
+	Log     bool
+}
+
 func replace(input, from, to string) string {
 	return strings.Replace(input, from, to, -1)
 }
 
+// quote returns s as a double quoted nginx string. Variables are still
+// expanded, but the value cannot end the directive.
+func quote(s string) string {
+	return "\"" + strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+}
+
+func locationKeys(locations map[string]Location) []string {
+	var keys []string
+	for key := range locations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// logName maps a server name, which may be a wildcard or a regex, to a name
+// usable in a log file path.
+func logName(serverName string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, serverName)
+}
+
+// requires returns an error about what when the nginx the configs are
+// rendered for is older than version.
+func requires(version, what string) error {
+	current := strings.Split(nginxVersion, ".")
+	for i, n := range strings.Split(version, ".") {
+		a, _ := strconv.Atoi(current[i])
+		b, _ := strconv.Atoi(n)
+		if a != b {
+			if a < b {
+				return errors.New(what + " requires nginx " + version + " or later, not " + nginxVersion + " !")
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// uniqueName names the zones, variables and internal locations of a location
+// of a server. Server names and location keys are mapped to word characters,
+// which several of them may share, so a hash of both is appended.
+func uniqueName(serverName, uri string) string {
+	name := uri
+	if name == "/" {
+		name = "root"
+	}
+	word := func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}
+	sum := sha1.Sum([]byte(serverName + " " + uri))
+	return strings.Map(word, serverName) + "_" + strings.Map(word, name) + "_" + hex.EncodeToString(sum[:4])
+}
+
+// logFormat returns the access log format, "main" unless "json" is chosen.
+func logFormat(format string) string {
+	if format == "json" {
+		return format
+	}
+	return "main"
+}
+
 func Init(conf InitConf) error {
 	var err error
 
-	nginxConfTmpl, err = template.ParseFiles(conf.NginxPath + "tmpl/nginx.conf.tmpl")
+	if conf.LogFormat != "" && conf.LogFormat != "main" && conf.LogFormat != "json" {
+		return errors.New("log format: " + conf.LogFormat + " must be main or json !")
+	}
+	if conf.RequestIDHeader == "" {
+		conf.RequestIDHeader = "X-Request-Id"
+	}
+	if !headerRegexp.MatchString(conf.RequestIDHeader) {
+		return errors.New("request id header: " + conf.RequestIDHeader + " is invalid !")
+	}
+	switch conf.RequestIDTrust {
+	case "":
+		conf.RequestIDTrust = "trusted"
+	case "trusted", "always", "never":
+	default:
+		return errors.New("request id trust: " + conf.RequestIDTrust + " must be trusted, always or never !")
+	}
+	switch conf.Tracing {
+	case "":
+		conf.Tracing = "off"
+	case "off", "propagate", "generate":
+	default:
+		return errors.New("tracing: " + conf.Tracing + " must be off, propagate or generate !")
+	}
+	// split_clients percentages have two decimals.
+	if conf.TraceSampleRatio < 0 || conf.TraceSampleRatio > 1 || conf.TraceSampleRatio != math.Round(conf.TraceSampleRatio*10000)/10000 {
+		return errors.New("trace sample ratio: " + strconv.FormatFloat(conf.TraceSampleRatio, 'f', -1, 64) + " must be between 0 and 1 with at most 4 decimals !")
+	}
+
+	if conf.NginxVersion == "" {
+		conf.NginxVersion = defaultNginxVersion
+	}
+	if !versionRegexp.MatchString(conf.NginxVersion) {
+		return errors.New("nginx version: " + conf.NginxVersion + " must be like 1.11.2 !")
+	}
+	nginxVersion = conf.NginxVersion
+
+	if conf.TmplPath == "" {
+		conf.TmplPath = conf.NginxPath + "tmpl/"
+	}
+	if conf.ConfPath == "" {
+		conf.ConfPath = conf.NginxPath + "conf/"
+	}
+	confPath = conf.ConfPath
+	offline = conf.Offline
+
+	nginxConfTmpl, err = template.ParseFiles(conf.TmplPath + "nginx.conf.tmpl")
 	if err != nil {
 		return err
 	}
 
-	proxyConfTmpl, err = template.ParseFiles(conf.NginxPath + "tmpl/proxy.conf.tmpl")
+	proxyConfTmpl, err = template.ParseFiles(conf.TmplPath + "proxy.conf.tmpl")
 	if err != nil {
 		return err
 	}
 
-	upstreamTmpl, err = template.ParseFiles(conf.NginxPath + "tmpl/upstream.conf.tmpl")
+	upstreamTmpl, err = template.ParseFiles(conf.TmplPath + "upstream.conf.tmpl")
 	if err != nil {
 		return err
 	}
 
-	serverTmpl, err = template.ParseFiles(conf.NginxPath + "tmpl/server.conf.tmpl")
+	serverTmpl, err = template.ParseFiles(conf.TmplPath + "server.conf.tmpl")
 	if err != nil {
 		return err
 	}
 
-	nginxConf := NginxConf{
+	streamTmpl, err = template.ParseFiles(conf.TmplPath + "stream.conf.tmpl")
+	if err != nil {
+		return err
+	}
+
+	nginxConf = NginxConf{
 		NginxPath:                 conf.NginxPath,
 		LogPath:                   conf.LogPath,
 		ServerName:                conf.ServerName,
@@ -141,6 +953,14 @@ func Init(conf InitConf) error {
 		ServerNamesHashMaxSize:    conf.ServerNamesHashMaxSize,
 		ServerNamesHashBucketSize: conf.ServerNamesHashBucketSize,
 		CheckShmSize:              conf.CheckShmSize,
+		RealIPFrom:                conf.RealIPFrom,
+		LogFormat:                 logFormat(conf.LogFormat),
+		JSONEscape:                requires("1.11.8", "escape=json") == nil,
+		StreamLog:                 requires("1.11.4", "stream access_log") == nil,
+		RequestIDHeader:           conf.RequestIDHeader,
+		RequestIDTrust:            conf.RequestIDTrust,
+		Tracing:                   conf.Tracing,
+		TraceSampleRatio:          conf.TraceSampleRatio,
 		ABTest:                    conf.ABTest,
 		RedisConf:                 conf.RedisConf,
 	}
@@ -152,9 +972,11 @@ func Init(conf InitConf) error {
 	log.Debugln("render nginx.conf success")
 
 	proxyConf := ProxyConf{
-		NginxPath: conf.NginxPath,
-		ABTest:    conf.ABTest,
-		RedisConf: conf.RedisConf,
+		NginxPath:       conf.NginxPath,
+		RequestIDHeader: nginxConf.RequestIDHeader,
+		Tracing:         nginxConf.Tracing != "off",
+		ABTest:          conf.ABTest,
+		RedisConf:       conf.RedisConf,
 	}
 
 	if err := renderProxyConf(proxyConf); err != nil {
@@ -163,7 +985,7 @@ func Init(conf InitConf) error {
 
 	log.Debugln("render proxy.conf success")
 
-	if f, err := os.Create(conf.NginxPath + "conf/server.conf"); err != nil {
+	if f, err := os.Create(confPath + "server.conf"); err != nil {
 		return err
 	} else {
 		err = f.Close()
@@ -174,7 +996,7 @@ func Init(conf InitConf) error {
 
 	log.Debugln("create server.conf success")
 
-	if f, err := os.Create(conf.NginxPath + "conf/upstream.conf"); err != nil {
+	if f, err := os.Create(confPath + "upstream.conf"); err != nil {
 		return err
 	} else {
 		err = f.Close()
@@ -185,6 +1007,26 @@ func Init(conf InitConf) error {
 
 	log.Debugln("create upstream.conf success")
 
+	if f, err := os.Create(confPath + "stream.conf"); err != nil {
+		return err
+	} else {
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debugln("create stream.conf success")
+
+	if conf.Offline {
+		if conf.HTTPS {
+			if err := loadCrt(conf.SSLPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
 	_, err = os.Stat(conf.NginxPath + "upstreams")
 	if os.IsNotExist(err) {
 		if err := os.Mkdir(conf.NginxPath+"upstreams", os.ModePerm); err != nil {
@@ -228,7 +1070,7 @@ func Init(conf InitConf) error {
 }
 
 func renderNginxConf(conf NginxConf) error {
-	f, err := os.Create(conf.NginxPath + "conf/nginx.conf")
+	f, err := os.Create(confPath + "nginx.conf")
 	if err != nil {
 		return err
 	}
@@ -241,7 +1083,7 @@ func renderNginxConf(conf NginxConf) error {
 }
 
 func renderProxyConf(conf ProxyConf) error {
-	f, err := os.Create(conf.NginxPath + "conf/proxy.conf")
+	f, err := os.Create(confPath + "proxy.conf")
 	if err != nil {
 		return err
 	}
@@ -254,14 +1096,27 @@ func renderProxyConf(conf ProxyConf) error {
 }
 
 func renderServerConf(config *Config, conf ServerConf) error {
-	f, err := os.Create(conf.NginxPath + "conf/server.conf")
+	f, err := os.Create(confPath + "server.conf")
 	if err != nil {
 		return err
 	}
+	location := func(serverName, uri string, location Location, tls bool) map[string]interface{} {
+		return map[string]interface{}{
+			"Conf":       conf,
+			"Replace":    replace,
+			"LogName":    logName,
+			"ServerName": serverName,
+			"URI":        uri,
+			"Location":   location,
+			"TLS":        tls,
+		}
+	}
 	err = serverTmpl.Execute(f, map[string]interface{}{
-		"Conf":    conf,
-		"Servers": config.Servers,
-		"Replace": replace,
+		"Conf":     conf,
+		"Servers":  config.Servers,
+		"Replace":  replace,
+		"LogName":  logName,
+		"Location": location,
 	})
 	if err != nil {
 		f.Close()
@@ -271,7 +1126,7 @@ func renderServerConf(config *Config, conf ServerConf) error {
 }
 
 func renderUpstreamConf(config *Config, conf UpstreamConf) error {
-	f, err := os.Create(conf.NginxPath + "conf/upstream.conf")
+	f, err := os.Create(confPath + "upstream.conf")
 	if err != nil {
 		return err
 	}
@@ -287,6 +1142,49 @@ func renderUpstreamConf(config *Config, conf UpstreamConf) error {
 	return f.Close()
 }
 
+// UpstreamSettings returns the upstreams without their servers, which upsync
+// updates. nginx has to be reloaded when the rest of an upstream changes.
+func UpstreamSettings(config *Config) map[string]Upstream {
+	upstreams := make(map[string]Upstream)
+	for name, upstream := range config.Upstreams {
+		upstream.Servers = nil
+		upstreams[name] = upstream
+	}
+	return upstreams
+}
+
+// StreamUpstreams returns the upstreams the streams proxy to. Their servers
+// are written in stream.conf, nginx has to be reloaded when they change.
+func StreamUpstreams(config *Config) map[string]Upstream {
+	upstreams := make(map[string]Upstream)
+	for _, server := range config.Streams {
+		if server.Upstream != "" {
+			upstreams[server.Upstream] = config.Upstreams[server.Upstream]
+		}
+		for _, upstream := range server.SNI {
+			upstreams[upstream] = config.Upstreams[upstream]
+		}
+	}
+	return upstreams
+}
+
+func renderStreamConf(config *Config, conf StreamConf) error {
+	f, err := os.Create(confPath + "stream.conf")
+	if err != nil {
+		return err
+	}
+	err = streamTmpl.Execute(f, map[string]interface{}{
+		"Conf":      conf,
+		"Streams":   config.Streams,
+		"Upstreams": StreamUpstreams(config),
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func loadCrt(sslPath string) error {
 	certs = make(map[string]*x509.Certificate)
 	files, err := ioutil.ReadDir(sslPath)
@@ -310,23 +1208,311 @@ func loadCrt(sslPath string) error {
 	return nil
 }
 
+// LoadCerts loads the certificates of sslPath for SSLCert, as Init does when
+// HTTPS is enabled.
+func LoadCerts(sslPath string) error {
+	return loadCrt(sslPath)
+}
+
+// SSLCert returns the name of the first certificate, in the order of their
+// names, covering the server name and its aliases, or "" if none does.
+func SSLCert(serverName string, server Server) string {
+	names := append([]string{serverName}, server.Aliases...)
+	for _, certName := range certNames() {
+		if certCovers(certs[certName], names) {
+			return certName
+		}
+	}
+	return ""
+}
+
+func certNames() []string {
+	var names []string
+	for certName := range certs {
+		names = append(names, certName)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func fixSSL(config *Config) {
-	for serverName := range config.Servers {
-		for certName, cert := range certs {
-			err := cert.VerifyHostname(serverName)
-			if err == nil {
-				v := config.Servers[serverName]
-				v.SSL = certName
-				config.Servers[serverName] = v
-				break
+	for serverName, server := range config.Servers {
+		if certName := SSLCert(serverName, server); certName != "" {
+			server.SSL = certName
+			config.Servers[serverName] = server
+		}
+	}
+}
+
+// certCovers reports whether cert is valid for all names. Wildcard names need
+// the same wildcard in the certificate and regex names cannot be verified, so
+// they are skipped; trailing wildcard names are never covered.
+func certCovers(cert *x509.Certificate, names []string) bool {
+	covered := false
+	for _, name := range names {
+		switch {
+		case strings.HasPrefix(name, "~"):
+			continue
+		case strings.HasPrefix(name, "*."), strings.HasPrefix(name, "."):
+			wildcard := "*" + name[strings.Index(name, "."):]
+			found := false
+			for _, dnsName := range cert.DNSNames {
+				if strings.EqualFold(dnsName, wildcard) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+			if strings.HasPrefix(name, ".") && cert.VerifyHostname(name[1:]) != nil {
+				return false
+			}
+		case strings.Contains(name, "*"):
+			return false
+		default:
+			if cert.VerifyHostname(name) != nil {
+				return false
+			}
+		}
+		covered = true
+	}
+	return covered
+}
+
+func fixLimits(config *Config) {
+	for serverName, server := range config.Servers {
+		for uri, location := range server.Locations {
+			limit := location.Limit
+			if (limit.Rate == "" && limit.Connections == 0) || location.SlashRedirect {
+				continue
+			}
+			limit.Zone = "limit_" + uniqueName(serverName, uri)
+			location.Limit = limit
+			server.Locations[uri] = location
+		}
+	}
+}
+
+// resolveAccess replaces the IP list names in access by their CIDRs.
+func resolveAccess(access Access, ipLists map[string][]string) (Access, error) {
+	var resolved Access
+	for i, cidrs := range [][]string{access.Allow, access.Deny} {
+		var result []string
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err == nil || net.ParseIP(cidr) != nil {
+				result = append(result, cidr)
+			} else if list, ok := ipLists[cidr]; ok {
+				result = append(result, list...)
+			} else {
+				return resolved, errors.New("access: " + cidr + " is neither a CIDR nor an IP list !")
+			}
+		}
+		if i == 0 {
+			resolved.Allow = result
+		} else {
+			resolved.Deny = result
+		}
+	}
+	return resolved, nil
+}
+
+func fixAccess(config *Config, conf RenderConf, d *dropped) {
+	for serverName, server := range config.Servers {
+		access, err := resolveAccess(server.Access, conf.IPLists)
+		if err != nil {
+			d.server(config, serverName, err)
+			continue
+		}
+		server.Access = access
+		for uri, location := range server.Locations {
+			access, err := resolveAccess(location.Access, conf.IPLists)
+			if err != nil {
+				d.location(config, serverName, uri, err)
+				continue
+			}
+			if len(access.Allow) > 0 || len(access.Deny) > 0 {
+				access.Deny = append(append([]string{}, server.Access.Deny...), access.Deny...)
+			}
+			location.Access = access
+			server.Locations[uri] = location
+		}
+		config.Servers[serverName] = server
+	}
+}
+
+func fixAuth(config *Config, conf RenderConf, d *dropped) {
+	for serverName, server := range config.Servers {
+		for uri, location := range server.Locations {
+			if location.SlashRedirect {
+				continue
+			}
+			if location.BasicAuth.File != "" {
+				if err := statFiles(conf.HtpasswdPath + location.BasicAuth.File + ".htpasswd"); err != nil {
+					d.location(config, serverName, uri, err)
+					continue
+				}
+				if location.BasicAuth.Realm == "" {
+					location.BasicAuth.Realm = "Restricted"
+				}
+			}
+			if location.AuthRequest.Proc != "" {
+				location.AuthRequest.Upstream = replace(location.AuthRequest.Proc, ".", "_")
+				location.AuthRequest.Scheme = "http"
+				if config.Upstreams[location.AuthRequest.Upstream].Protocol == "https" {
+					location.AuthRequest.Scheme = "https"
+				}
+				location.AuthRequest.Location = "/_webrouter_auth/" + uniqueName(serverName, uri)
+			}
+			server.Locations[uri] = location
+		}
+	}
+}
+
+// fixErrorPages drops the error pages and the maintenance pages which do not
+// exist, nginx then serves its own.
+func fixErrorPages(config *Config, conf RenderConf, d *dropped) {
+	for serverName, server := range config.Servers {
+		for _, code := range server.ErrorCodes() {
+			if err := statFiles(conf.ErrorPagePath + server.ErrorPages[code]); err != nil {
+				delete(server.ErrorPages, code)
+				d.warn(errors.New("servername: " + serverName + " error page: " + code + " skipped: " + err.Error()))
+			}
+		}
+		for uri, location := range server.Locations {
+			if !location.Maintenance.Enabled || location.SlashRedirect {
+				continue
+			}
+			if location.Maintenance.Page != "" {
+				if err := statFiles(conf.ErrorPagePath + location.Maintenance.Page); err != nil {
+					location.Maintenance.Page = ""
+					d.warn(errors.New("servername: " + serverName + " location: " + uri + " maintenance page skipped: " + err.Error()))
+				}
+			}
+			location.Maintenance.Location = "/_webrouter_maintenance/" + uniqueName(serverName, uri)
+			server.Locations[uri] = location
+		}
+	}
+}
+
+// fixMirrors drops the mirrors to upstreams which do not exist, and all of
+// them when nginx has no mirror module.
+func fixMirrors(config *Config, d *dropped) {
+	for serverName, server := range config.Servers {
+		for uri, location := range server.Locations {
+			if len(location.Mirrors) == 0 || location.SlashRedirect {
+				continue
+			}
+			if err := requires("1.13.4", "mirror"); err != nil {
+				location.Mirrors = nil
+				server.Locations[uri] = location
+				d.warn(errors.New("servername: " + serverName + " location: " + uri + " mirrors skipped: " + err.Error()))
+				continue
+			}
+			var mirrors []Mirror
+			for _, mirror := range location.Mirrors {
+				upstream, ok := config.Upstreams[mirror.Upstream]
+				if !ok {
+					d.warn(errors.New("servername: " + serverName + " location: " + uri +
+						" mirror skipped: upstream: " + mirror.Upstream + " does not exist !"))
+					continue
+				}
+				mirror.Scheme = "http"
+				if upstream.Protocol == "https" {
+					mirror.Scheme = "https"
+				}
+				mirror.Location = "/_webrouter_mirror/" + uniqueName(serverName, uri) + "/" + mirror.Upstream
+				if mirror.Percentage < 100 {
+					mirror.Variable = "$mirror_" + uniqueName(serverName, uri) + "_" + mirror.Upstream
+				}
+				mirrors = append(mirrors, mirror)
+			}
+			location.Mirrors = mirrors
+			server.Locations[uri] = location
+		}
+	}
+}
+
+// CacheDir returns the directory holding the cache zones of an app.
+func CacheDir(cachePath, app string) string {
+	return cachePath + app + "/"
+}
+
+func fixCaches(config *Config, conf RenderConf, d *dropped) ([]Cache, error) {
+	var caches []Cache
+	for serverName, server := range config.Servers {
+		for uri, location := range server.Locations {
+			if !location.Cache.Enabled || location.SlashRedirect {
+				continue
+			}
+			if location.GRPC() {
+				d.location(config, serverName, uri, errors.New("cache requires backend_protocol http or https !"))
+				continue
 			}
+			if location.Cache.Background {
+				if err := requires("1.11.10", "proxy_cache_background_update"); err != nil {
+					location.Cache.Background = false
+					d.warn(errors.New("servername: " + serverName + " location: " + uri + " cache background skipped: " + err.Error()))
+				}
+			}
+			location.Cache.Zone = "cache_" + uniqueName(serverName, uri)
+			location.Cache.Path = CacheDir(conf.CachePath, location.App) + location.Cache.Zone
+			if !offline {
+				if err := os.MkdirAll(CacheDir(conf.CachePath, location.App), os.ModePerm); err != nil {
+					return nil, err
+				}
+			}
+			server.Locations[uri] = location
+			caches = append(caches, location.Cache)
 		}
 	}
+	sort.Slice(caches, func(i, j int) bool {
+		return caches[i].Zone < caches[j].Zone
+	})
+	return caches, nil
+}
+
+func fixAffinity(config *Config) {
+	for _, server := range config.Servers {
+		for uri, location := range server.Locations {
+			upstream := config.Upstreams[location.Upstream]
+			if upstream.Balance.Method != "cookie" || location.SlashRedirect {
+				continue
+			}
+			location.Affinity = upstream.Balance.SetCookie(location.Upstream)
+			server.Locations[uri] = location
+		}
+	}
+}
+
+func fixCORS(config *Config) {
+	for serverName, server := range config.Servers {
+		for uri, location := range server.Locations {
+			if len(location.CORS.Origins) == 0 || location.SlashRedirect {
+				continue
+			}
+			location.CORS.Variable = "$cors_" + uniqueName(serverName, uri)
+			server.Locations[uri] = location
+		}
+	}
+}
+
+// ABTestable reports whether the requests of a location can be diverted to
+// the canary of its upstream, which is only done for the prefix locations of
+// exact server names.
+func ABTestable(serverName string, location Location) bool {
+	if strings.HasPrefix(serverName, "~") || strings.HasPrefix(serverName, ".") || strings.Contains(serverName, "*") {
+		return false
+	}
+	return (location.Match == "" || location.Match == "prefix") && !location.SlashRedirect
 }
 
 func fixABTest(config *Config) {
 	for serverName, server := range config.Servers {
 		for uri, location := range server.Locations {
+			if !ABTestable(serverName, location) {
+				continue
+			}
 			if _, ok := config.Upstreams[location.Upstream+"_canary"]; ok {
 				v := config.Servers[serverName].Locations[uri]
 				v.ABTest = true
@@ -340,6 +1526,133 @@ func fixABTest(config *Config) {
 	}
 }
 
+// fixClientAuth sets the client CA of the servers. The locations are visited
+// in order so that the same one is dropped when two of them disagree on it.
+func fixClientAuth(config *Config, conf RenderConf, d *dropped) {
+	for serverName, server := range config.Servers {
+		for _, uri := range locationKeys(server.Locations) {
+			location := server.Locations[uri]
+			if location.ClientAuth.Verify == "" {
+				continue
+			}
+			if !conf.HTTPS || server.SSL == "" {
+				d.location(config, serverName, uri, errors.New("client_auth requires a TLS certificate for the server !"))
+				continue
+			}
+			if server.ClientCA != "" && server.ClientCA != location.ClientAuth.CA {
+				d.location(config, serverName, uri, errors.New("ca1: "+server.ClientCA+" ca2: "+location.ClientAuth.CA+" duplicate client_auth ca !"))
+				continue
+			}
+			depth := location.ClientAuth.Depth
+			if depth == 0 {
+				depth = defaultVerifyDepth
+			}
+			if server.ClientCA != "" && server.ClientDepth != depth {
+				d.location(config, serverName, uri, errors.New("depth1: "+strconv.Itoa(server.ClientDepth)+" depth2: "+strconv.Itoa(depth)+" conflicting client_auth depth !"))
+				continue
+			}
+			if err := statFiles(conf.SSLPath + location.ClientAuth.CA + ".ca.pem"); err != nil {
+				d.location(config, serverName, uri, err)
+				continue
+			}
+			server.ClientCA = location.ClientAuth.CA
+			server.ClientDepth = depth
+			config.Servers[serverName] = server
+		}
+	}
+}
+
+func fixBackendProtocol(config *Config, conf RenderConf, d *dropped) {
+	for serverName, server := range config.Servers {
+		for uri, location := range server.Locations {
+			var files []string
+			if location.BackendTLS.CA != "" {
+				files = append(files, conf.SSLPath+location.BackendTLS.CA+".ca.pem")
+			}
+			if location.BackendTLS.Cert != "" {
+				files = append(files, conf.SSLPath+location.BackendTLS.Cert+".client.pem", conf.SSLPath+location.BackendTLS.Cert+".client.key")
+			}
+			if err := statFiles(files...); err != nil {
+				d.location(config, serverName, uri, err)
+				continue
+			}
+			if location.GRPC() {
+				if err := requires("1.13.10", "backend_protocol "+location.BackendProtocol); err != nil {
+					d.location(config, serverName, uri, err)
+					continue
+				}
+				if !conf.HTTPS || server.SSL == "" {
+					d.location(config, serverName, uri, errors.New("backend_protocol "+location.BackendProtocol+" requires a TLS certificate for the server !"))
+					continue
+				}
+				server.HTTP2 = true
+				config.Servers[serverName] = server
+			}
+		}
+	}
+}
+
+// statFiles returns the error of the first file which cannot be stat. The
+// files are not checked offline, the secrets of production may be missing.
+func statFiles(files ...string) error {
+	if offline {
+		return nil
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fixStreams(config *Config, conf RenderConf, d *dropped) {
+	for key, server := range config.Streams {
+		stream := Stream{
+			Port:       server.Port,
+			Protocol:   server.Protocol,
+			TLS:        server.TLS,
+			ServerName: server.ServerName,
+		}
+		if err := stream.Validate(); err != nil {
+			d.stream(config, key, err)
+			continue
+		}
+		port := strconv.Itoa(server.Port)
+		// ssl_preread has been added in 1.11.5, the access log of streams is
+		// only written from 1.11.4.
+		if server.TLS == "passthrough" {
+			if err := requires("1.11.5", "stream port: "+port+" tls passthrough"); err != nil {
+				d.stream(config, key, err)
+				continue
+			}
+		}
+		switch server.TLS {
+		case "terminate":
+			if !conf.HTTPS {
+				d.stream(config, key, errors.New("stream port: "+port+" tls terminate requires https to be enabled !"))
+				continue
+			}
+			for _, certName := range certNames() {
+				if certs[certName].VerifyHostname(server.ServerName) == nil {
+					server.SSL = certName
+					break
+				}
+			}
+			if server.SSL == "" {
+				d.stream(config, key, errors.New("stream port: "+port+" server_name: "+server.ServerName+" has no certificate !"))
+				continue
+			}
+			config.Streams[key] = server
+		case "passthrough":
+			if _, ok := server.SNI[""]; ok {
+				d.stream(config, key, errors.New("stream port: "+port+" tls passthrough requires server_name !"))
+				continue
+			}
+		}
+	}
+}
+
 func Reload(path string) error {
 	pidfile.SetPidfilePath(path)
 	pid, err := pidfile.Read()
@@ -357,22 +1670,100 @@ func Reload(path string) error {
 	return nil
 }
 
-func Render(config *Config, conf RenderConf) error {
+// dropped collects the warnings about the parts of a config which Render
+// drops as nginx would reject them, so that one bad annotation does not keep
+// every other app from being routed.
+type dropped []error
+
+func (d *dropped) warn(err error) {
+	*d = append(*d, err)
+}
+
+// location drops a location of a server along with its bare path twin.
+func (d *dropped) location(config *Config, serverName, uri string, err error) {
+	locations := config.Servers[serverName].Locations
+	location := locations[uri]
+	for key, l := range locations {
+		if l.Proc == location.Proc && l.Upstream == location.Upstream && l.Path == location.Path {
+			delete(locations, key)
+		}
+	}
+	d.warn(errors.New("servername: " + serverName + " location: " + uri + " skipped: " + err.Error()))
+}
+
+func (d *dropped) server(config *Config, serverName string, err error) {
+	delete(config.Servers, serverName)
+	d.warn(errors.New("servername: " + serverName + " skipped: " + err.Error()))
+}
+
+func (d *dropped) stream(config *Config, key string, err error) {
+	delete(config.Streams, key)
+	d.warn(errors.New("stream: " + key + " skipped: " + err.Error()))
+}
+
+// warnings returns the warnings sorted, as the config is visited in no
+// particular order.
+func (d dropped) warnings() []error {
+	warnings := append([]error{}, d...)
+	sort.Slice(warnings, func(i, j int) bool {
+		return warnings[i].Error() < warnings[j].Error()
+	})
+	return warnings
+}
+
+// dropEmptyServers drops the servers left without locations.
+func dropEmptyServers(config *Config) {
+	for serverName, server := range config.Servers {
+		if len(server.Locations) == 0 {
+			delete(config.Servers, serverName)
+		}
+	}
+}
+
+// Render renders the configs of config. What nginx would reject is dropped
+// from config rather than failing the render, the warnings returned report
+// it. The error is only returned when the configs cannot be written.
+func Render(config *Config, conf RenderConf) ([]error, error) {
+	var d dropped
 	if conf.HTTPS {
 		fixSSL(config)
 	}
+	validateLocations(config, &d)
+	validateUpstreams(config, &d)
+	fixClientAuth(config, conf, &d)
+	fixLimits(config)
+	fixAccess(config, conf, &d)
+	fixAuth(config, conf, &d)
+	fixCORS(config)
+	fixErrorPages(config, conf, &d)
+	fixMirrors(config, &d)
+	fixAffinity(config)
+	fixBackendProtocol(config, conf, &d)
+	caches, err := fixCaches(config, conf, &d)
+	if err != nil {
+		return d.warnings(), err
+	}
+	fixStreams(config, conf, &d)
+	dropEmptyServers(config)
+	nginxConf.Streams = len(config.Streams) > 0
 	if conf.ABTest {
 		fixABTest(config)
 	}
 	serverConf := ServerConf{
-		NginxPath: conf.NginxPath,
-		LogPath:   conf.LogPath,
-		HTTPS:     conf.HTTPS,
-		SSLPath:   conf.SSLPath,
-		ABTest:    conf.ABTest,
+		NginxPath:       conf.NginxPath,
+		LogPath:         conf.LogPath,
+		HTTPS:           conf.HTTPS,
+		SSLPath:         conf.SSLPath,
+		HtpasswdPath:    conf.HtpasswdPath,
+		ErrorPagePath:   conf.ErrorPagePath,
+		LogFormat:       logFormat(conf.LogFormat),
+		NoLocationLog:   conf.NoLocationLog,
+		RequestIDHeader: nginxConf.RequestIDHeader,
+		Tracing:         nginxConf.Tracing != "off",
+		ABTest:          conf.ABTest,
 	}
 	if err := renderServerConf(config, serverConf); err != nil {
-		return err
+		return d.warnings(), err
 	}
 	upstreamConf := UpstreamConf{
 		NginxPath:    conf.NginxPath,
@@ -380,7 +1771,19 @@ func Render(config *Config, conf RenderConf) error {
 		ConsulPrefix: conf.ConsulPrefix,
 	}
 	if err := renderUpstreamConf(config, upstreamConf); err != nil {
-		return err
+		return d.warnings(), err
 	}
-	return nil
+	streamConf := StreamConf{
+		LogPath: conf.LogPath,
+		SSLPath: conf.SSLPath,
+		Log:     nginxConf.StreamLog,
+	}
+	if err := renderStreamConf(config, streamConf); err != nil {
+		return d.warnings(), err
+	}
+	nginxConf.Caches = caches
+	if err := renderNginxConf(nginxConf); err != nil {
+		return d.warnings(), err
+	}
+	return d.warnings(), nil
 }
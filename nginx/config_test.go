@@ -0,0 +1,90 @@
+package nginx
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocationDirectives(t *testing.T) {
+	tests := []struct {
+		location    Location
+		pattern     string
+		rewrite     string
+		logLocation string
+	}{
+		{Location{Path: "/"}, `/`, ``, `"/"`},
+		{Location{Path: "api"}, `/api/`, `/api/(.*) /$1`, `"/api/"`},
+		{Location{Path: "api", KeepPrefix: true}, `/api/`, ``, `"/api/"`},
+		{Location{Path: "api", ReplacePrefix: "/v1/"}, `/api/`, `/api/(.*) /v1/$1`, `"/api/"`},
+		{Location{Path: "/", ReplacePrefix: "/v1/"}, `/`, `/(.*) /v1/$1`, `"/"`},
+		{Location{Match: "exact", Path: "/"}, `= /`, ``, `"= /"`},
+		{Location{Match: "exact", Path: "login"}, `= /login`, `^ /`, `"= /login"`},
+		{Location{Match: "exact", Path: "login", KeepPrefix: true}, `= /login`, ``, `"= /login"`},
+		{Location{Match: "regex", Path: `img/.*\.png`}, `~ "^/img/.*\.png"`,
+			`"^/(?:img/.*\.png)/?(?<webrouter_path>.*)$" /$webrouter_path`, `"~ ^/img/.*\\.png"`},
+		{Location{Match: "regex", Path: `v[0-9]+$`, ReplacePrefix: "/api/"}, `~ "^/v[0-9]+$"`,
+			`"^/(?:v[0-9]+$)/?(?<webrouter_path>.*)$" /api/$webrouter_path`, `"~ ^/v[0-9]+${webrouter_dollar}"`},
+	}
+	for _, test := range tests {
+		l := test.location
+		if got := l.Pattern(); got != test.pattern {
+			t.Errorf("%s %s: pattern %s, want %s", l.Match, l.Path, got, test.pattern)
+		}
+		if got := l.Rewrite(); got != test.rewrite {
+			t.Errorf("%s %s: rewrite %s, want %s", l.Match, l.Path, got, test.rewrite)
+		}
+		if got := l.LogLocation(); got != test.logLocation {
+			t.Errorf("%s %s: log location %s, want %s", l.Match, l.Path, got, test.logLocation)
+		}
+	}
+}
+
+func TestLocationKey(t *testing.T) {
+	tests := []struct {
+		match, path, key string
+	}{
+		{"", "api", "api"},
+		{"prefix", "api", "api"},
+		{"exact", "api", "=api"},
+		{"regex", "api", "~api"},
+	}
+	for _, test := range tests {
+		if got := LocationKey(test.match, test.path); got != test.key {
+			t.Errorf("%s %s: key %q, want %q", test.match, test.path, got, test.key)
+		}
+	}
+}
+
+func TestHeadersDirectives(t *testing.T) {
+	headers := Headers{
+		Request: HeaderRules{
+			Add:    map[string]string{"X-B": "2", "X-A": `say "hi"`},
+			Set:    map[string]string{"X-Env": "prod"},
+			Remove: []string{"Cookie"},
+		},
+		Response: HeaderRules{
+			Add:    map[string]string{"X-Frame-Options": "DENY"},
+			Set:    map[string]string{"Cache-Control": "no-store"},
+			Remove: []string{"Server"},
+		},
+	}
+	request := []string{
+		`proxy_set_header X-A "say \"hi\""`,
+		`proxy_set_header X-B "2"`,
+		`proxy_set_header X-Env "prod"`,
+		`proxy_set_header Cookie ""`,
+	}
+	if got := headers.RequestDirectives("proxy"); !reflect.DeepEqual(got, request) {
+		t.Errorf("request directives\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(request, "\n"))
+	}
+	response := []string{
+		`add_header X-Frame-Options "DENY" always`,
+		`grpc_hide_header Cache-Control`,
+		`add_header Cache-Control "no-store" always`,
+		`grpc_hide_header Server`,
+	}
+	if got := headers.ResponseDirectives("grpc"); !reflect.DeepEqual(got, response) {
+		t.Errorf("response directives\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(response, "\n"))
+	}
+}
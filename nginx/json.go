@@ -0,0 +1,53 @@
+package nginx
+
+import (
+	"encoding/json"
+)
+
+// The fields set when rendering are left out of the annotations with
+// json:"-", the marshallers below add them back so that the config served
+// by the admin API shows the zones, variables and internal locations the
+// templates use.
+
+func (l Limit) MarshalJSON() ([]byte, error) {
+	type limit Limit
+	return json.Marshal(struct {
+		limit
+		Zone string `json:"zone,omitempty"`
+	}{limit(l), l.Zone})
+}
+
+func (a AuthRequest) MarshalJSON() ([]byte, error) {
+	type authRequest AuthRequest
+	return json.Marshal(struct {
+		authRequest
+		Upstream string `json:"upstream,omitempty"`
+		Scheme   string `json:"scheme,omitempty"`
+		Location string `json:"location,omitempty"`
+	}{authRequest(a), a.Upstream, a.Scheme, a.Location})
+}
+
+func (c CORS) MarshalJSON() ([]byte, error) {
+	type cors CORS
+	return json.Marshal(struct {
+		cors
+		Variable string `json:"variable,omitempty"`
+	}{cors(c), c.Variable})
+}
+
+func (m Maintenance) MarshalJSON() ([]byte, error) {
+	type maintenance Maintenance
+	return json.Marshal(struct {
+		maintenance
+		Location string `json:"location,omitempty"`
+	}{maintenance(m), m.Location})
+}
+
+func (c Cache) MarshalJSON() ([]byte, error) {
+	type cache Cache
+	return json.Marshal(struct {
+		cache
+		Zone string `json:"zone,omitempty"`
+		Path string `json:"path,omitempty"`
+	}{cache(c), c.Zone, c.Path})
+}
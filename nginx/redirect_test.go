@@ -0,0 +1,169 @@
+package nginx
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// directive is a rewrite phase directive of a rendered location.
+type directive struct {
+	pattern *regexp.Regexp
+	target  string
+	status  int
+}
+
+var (
+	ifRegexp      = regexp.MustCompile(`^if \(\$uri ~ (".*")\) \{$`)
+	returnRegexp  = regexp.MustCompile(`^return ([0-9]+) (".*");$`)
+	rewriteRegexp = regexp.MustCompile(`^rewrite ("(?:[^"\\]|\\.)*"|\S+) ("(?:[^"\\]|\\.)*"|\S+) break;$`)
+	captureRegexp = regexp.MustCompile(`\$([0-9])`)
+)
+
+func unquote(s string) string {
+	if !strings.HasPrefix(s, "\"") {
+		return s
+	}
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(s[1 : len(s)-1])
+}
+
+// locationDirectives extracts the redirect and rewrite directives of the
+// location block opened by header from a rendered server.conf.
+func locationDirectives(t *testing.T, conf, header string) []directive {
+	var directives []directive
+	var pending *regexp.Regexp
+	inside := false
+	for _, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if !inside {
+			inside = line == header
+			continue
+		}
+		if line == "}" && pending == nil {
+			return directives
+		}
+		if m := ifRegexp.FindStringSubmatch(line); m != nil {
+			pending = regexp.MustCompile(unquote(m[1]))
+		} else if m := returnRegexp.FindStringSubmatch(line); m != nil && pending != nil {
+			status, _ := strconv.Atoi(m[1])
+			directives = append(directives, directive{pattern: pending, target: unquote(m[2]), status: status})
+		} else if line == "}" {
+			pending = nil
+		} else if m := rewriteRegexp.FindStringSubmatch(line); m != nil {
+			directives = append(directives, directive{pattern: regexp.MustCompile(unquote(m[1])), target: unquote(m[2])})
+		}
+	}
+	t.Fatalf("location %q not found in:\n%s", header, conf)
+	return nil
+}
+
+// route applies the directives to a request the way nginx does and returns
+// the redirect status and location, or 0 and the URI passed to the upstream.
+func route(directives []directive, uri, args string) (int, string) {
+	for _, d := range directives {
+		m := d.pattern.FindStringSubmatch(uri)
+		if m == nil {
+			continue
+		}
+		target := captureRegexp.ReplaceAllStringFunc(d.target, func(s string) string {
+			if i := int(s[1] - '0'); i < len(m) {
+				return m[i]
+			}
+			return ""
+		})
+		isArgs := ""
+		if args != "" {
+			isArgs = "?"
+		}
+		target = strings.Replace(target, "$is_args$args", isArgs+args, -1)
+		if d.status != 0 {
+			return d.status, target
+		}
+		if strings.HasSuffix(target, "?") {
+			return 0, strings.TrimSuffix(target, "?")
+		}
+		return 0, target + isArgs + args
+	}
+	return 0, uri
+}
+
+func TestRedirects(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {
+				Locations: map[string]Location{
+					"api": {
+						Upstream: "a_web_web",
+						Path:     "api",
+						Redirects: []Redirect{
+							{Match: `^/api/old/(.*)$`, Target: "https://b.org/new/$1", Status: 301, PreserveQuery: true},
+							{Match: `^/api/tmp$`, Target: "/api/else", Status: 302},
+							{Match: `^/api/v1/(\w+)$`, Target: "/v2/$1", PreserveQuery: true},
+							{Match: `^/api/legacy\.php$`, Target: "/index"},
+						},
+					},
+				},
+			},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	if warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/"}); err != nil || len(warnings) > 0 {
+		t.Fatal(warnings, err)
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directives := locationDirectives(t, string(b), "location /api/ {")
+
+	tests := []struct {
+		uri, args string
+		status    int
+		target    string
+	}{
+		{"/api/old/x/y", "q=1", 301, "https://b.org/new/x/y?q=1"},
+		{"/api/old/x", "", 301, "https://b.org/new/x"},
+		{"/api/tmp", "q=1", 302, "/api/else"},
+		{"/api/v1/users", "id=2", 0, "/v2/users?id=2"},
+		{"/api/v1/users/2", "", 0, "/v1/users/2"},
+		{"/api/legacy.php", "id=2", 0, "/index"},
+		{"/api/legacyXphp", "", 0, "/legacyXphp"},
+		{"/api/foo", "a=b", 0, "/foo?a=b"},
+	}
+	for _, test := range tests {
+		status, target := route(directives, test.uri, test.args)
+		if status != test.status || target != test.target {
+			t.Errorf("%s?%s routed to %d %s, want %d %s", test.uri, test.args, status, target, test.status, test.target)
+		}
+	}
+}
+
+func TestRedirectValidate(t *testing.T) {
+	tests := []struct {
+		redirect Redirect
+		valid    bool
+	}{
+		{Redirect{Match: "^/a$", Target: "/b", Status: 308}, true},
+		{Redirect{Match: "^/a$", Target: "https://b.org/", Status: 307}, true},
+		{Redirect{Match: "^/a$", Target: "/b"}, true},
+		{Redirect{Match: "", Target: "/b"}, false},
+		{Redirect{Match: "^/a$", Target: "https://b.org/"}, false},
+		{Redirect{Match: "^/a$", Target: "b", Status: 301}, false},
+		{Redirect{Match: "^/a$", Target: "/b", Status: 200}, false},
+		{Redirect{Match: "^/a$", Target: "/b\nreturn 200", Status: 301}, false},
+	}
+	for _, test := range tests {
+		err := Location{Redirects: []Redirect{test.redirect}}.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.redirect, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,1005 @@
+package nginx
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// initTemp initializes the package with conf, the templates of the repo and
+// a temporary nginx directory, which it returns.
+func initTemp(t *testing.T, conf InitConf) string {
+	dir, err := ioutil.TempDir("", "webrouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := filepath.Abs("../rootfs/usr/local/openresty/nginx/tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nginxPath := dir + "/"
+	if err := os.Symlink(tmpl, nginxPath+"tmpl"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(nginxPath+"conf", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	conf.NginxPath = nginxPath
+	conf.LogPath = nginxPath + "logs/"
+	conf.PidPath = nginxPath + "pid"
+	if err := Init(conf); err != nil {
+		t.Fatal(err)
+	}
+	return nginxPath
+}
+
+func messages(errs []error) []string {
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+func TestRenderDrops(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{NginxVersion: "1.13.4"})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {
+				Locations: map[string]Location{
+					"/":     {Proc: "a.web.web", Upstream: "a_web_web", Path: "/"},
+					"admin": {Proc: "b.web.web", Upstream: "b_web_web", Path: "admin", BarePath: "redirect", BasicAuth: BasicAuth{File: "missing"}},
+					"=admin": {Proc: "b.web.web", Upstream: "b_web_web", Path: "admin", Match: "exact", BarePath: "redirect", SlashRedirect: true,
+						BasicAuth: BasicAuth{File: "missing"}},
+					"api": {Proc: "c.web.web", Upstream: "c_web_web", Path: "api", Access: Access{Allow: []string{"office"}}},
+				},
+			},
+			"b.org": {
+				Access: Access{Deny: []string{"unknown"}},
+				Locations: map[string]Location{
+					"/": {Proc: "b.web.web", Upstream: "b_web_web", Path: "/"},
+				},
+			},
+			"c.org": {
+				ErrorPages: map[string]string{"503": "missing.html"},
+				Locations: map[string]Location{
+					"/": {Proc: "c.web.web", Upstream: "c_web_web", Path: "/", Mirrors: []Mirror{{Upstream: "d_web_web", Percentage: 100}}},
+				},
+			},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+			"b_web_web": {Servers: []string{"127.0.0.1:8081"}},
+			"c_web_web": {Servers: []string{"127.0.0.1:8082"}, Balance: Balance{Method: "hash", Key: "bad"}},
+		},
+		Streams: map[string]StreamServer{
+			"tcp_80": {Port: 80, Upstream: "a_web_web"},
+		},
+	}
+	conf := RenderConf{
+		NginxPath:     nginxPath,
+		LogPath:       nginxPath + "logs/",
+		HtpasswdPath:  nginxPath + "htpasswd/",
+		ErrorPagePath: nginxPath + "error_pages/",
+		IPLists:       map[string][]string{"office": {"10.1.0.0/16"}},
+	}
+	warnings, err := Render(config, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"servername: a.org location: admin skipped: stat " + nginxPath + "htpasswd/missing.htpasswd: no such file or directory",
+		"servername: b.org skipped: access: unknown is neither a CIDR nor an IP list !",
+		"servername: c.org error page: 503 skipped: stat " + nginxPath + "error_pages/missing.html: no such file or directory",
+		"servername: c.org location: / mirror skipped: upstream: d_web_web does not exist !",
+		"stream: tcp_80 skipped: stream port: 80 is reserved for http !",
+		"upstream: c_web_web balance skipped: load_balance key: bad must be uri, header:<name> or cookie:<name> !",
+	}
+	if got := messages(warnings); !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	var servers, locations []string
+	for serverName, server := range config.Servers {
+		servers = append(servers, serverName)
+		for key := range server.Locations {
+			locations = append(locations, serverName+" "+key)
+		}
+	}
+	if want := []string{"a.org /", "a.org api", "c.org /"}; !equalSorted(locations, want) {
+		t.Errorf("locations %q, want %q", locations, want)
+	}
+	if len(config.Streams) > 0 || len(config.Servers["c.org"].ErrorPages) > 0 || len(config.Servers["c.org"].Locations["/"].Mirrors) > 0 {
+		t.Errorf("streams, error pages or mirrors left in %+v", config)
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "b.org") || strings.Contains(string(b), "/admin") || !strings.Contains(string(b), "10.1.0.0/16") {
+		t.Errorf("unexpected server.conf\n%s", b)
+	}
+}
+
+func equalSorted(a, b []string) bool {
+	a = append([]string(nil), a...)
+	sort.Strings(a)
+	return reflect.DeepEqual(a, b)
+}
+
+// TestRenderOffline checks that offline renders keep the locations whose
+// files are missing, reviewers may not have the secrets of production.
+func TestRenderOffline(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{Offline: true})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {
+				ErrorPages: map[string]string{"503": "missing.html"},
+				Locations: map[string]Location{
+					"/":     {Proc: "a.web.web", Upstream: "a_web_web", Path: "/", Maintenance: Maintenance{Enabled: true, Page: "missing.html"}},
+					"admin": {Proc: "a.web.web", Upstream: "a_web_web", Path: "admin", BasicAuth: BasicAuth{File: "missing"}},
+				},
+			},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	conf := RenderConf{
+		NginxPath:     nginxPath,
+		LogPath:       nginxPath + "logs/",
+		HtpasswdPath:  nginxPath + "htpasswd/",
+		ErrorPagePath: nginxPath + "error_pages/",
+	}
+	warnings, err := Render(config, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("warnings %q", messages(warnings))
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"auth_basic_user_file " + nginxPath + "htpasswd/missing.htpasswd;",
+		"alias " + nginxPath + "error_pages/missing.html;",
+		"error_page 503 /_webrouter_errors/missing.html;",
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("no %s in server.conf\n%s", s, b)
+		}
+	}
+}
+
+func TestRenderStreams(t *testing.T) {
+	tests := []struct {
+		version  string
+		streams  []string
+		warnings []string
+		log      bool
+	}{
+		{
+			// The default version, the one of the release image.
+			version:  "",
+			streams:  []string{"tcp_2222"},
+			warnings: []string{"stream: tcp_8443 skipped: stream port: 8443 tls passthrough requires nginx 1.11.5 or later, not 1.11.2 !"},
+		},
+		{
+			version:  "1.11.4",
+			streams:  []string{"tcp_2222"},
+			warnings: []string{"stream: tcp_8443 skipped: stream port: 8443 tls passthrough requires nginx 1.11.5 or later, not 1.11.4 !"},
+			log:      true,
+		},
+		{
+			version: "1.13.6",
+			streams: []string{"tcp_2222", "tcp_8443"},
+			log:     true,
+		},
+	}
+	for _, test := range tests {
+		nginxPath := initTemp(t, InitConf{NginxVersion: test.version})
+		defer os.RemoveAll(nginxPath)
+		config := Config{
+			Upstreams: map[string]Upstream{
+				"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+				"b_web_web": {Servers: []string{"127.0.0.1:8081"}},
+			},
+			Streams: map[string]StreamServer{
+				"tcp_2222": {Port: 2222, Upstream: "a_web_web"},
+				"tcp_8443": {Port: 8443, TLS: "passthrough", ServerName: "b.org", SNI: map[string]string{"b.org": "b_web_web"}},
+			},
+		}
+		warnings, err := Render(&config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messages(warnings); !reflect.DeepEqual(got, test.warnings) {
+			t.Errorf("%s: warnings %q, want %q", test.version, got, test.warnings)
+		}
+		var streams []string
+		for key := range config.Streams {
+			streams = append(streams, key)
+		}
+		if !equalSorted(streams, test.streams) {
+			t.Errorf("%s: streams %q, want %q", test.version, streams, test.streams)
+		}
+		b, err := ioutil.ReadFile(nginxPath + "conf/nginx.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "stream {") != (len(test.streams) > 0) {
+			t.Errorf("%s: stream block rendered with streams %q", test.version, test.streams)
+		}
+		if strings.Contains(string(b), "$session_time") != test.log {
+			t.Errorf("%s: stream log_format rendered, want %v in\n%s", test.version, test.log, b)
+		}
+		b, err = ioutil.ReadFile(nginxPath + "conf/stream.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), "listen 2222;\n    proxy_pass a_web_web;\n") {
+			t.Errorf("%s: tcp_2222 not rendered in\n%s", test.version, b)
+		}
+		if strings.Contains(string(b), "access_log") != test.log {
+			t.Errorf("%s: stream access_log rendered, want %v in\n%s", test.version, test.log, b)
+		}
+	}
+}
+
+func TestRenderClientAuth(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+	certs = map[string]*x509.Certificate{"a.org": {DNSNames: []string{"a.org"}}}
+	defer func() { certs = nil }()
+	if err := ioutil.WriteFile(nginxPath+"clients.ca.pem", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {
+				Locations: map[string]Location{
+					"/":   {Upstream: "a_web_web", Path: "/", ClientAuth: ClientAuth{Verify: "optional", CA: "clients"}},
+					"api": {Upstream: "a_web_web", Path: "api", ClientAuth: ClientAuth{Verify: "on", CA: "clients", Depth: 3}},
+				},
+			},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/", HTTPS: true, SSLPath: nginxPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"servername: a.org location: api skipped: depth1: 2 depth2: 3 conflicting client_auth depth !"}
+	if got := messages(warnings); !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := strings.SplitN(string(b), "listen 443 ssl;", 2)
+	if len(blocks) != 2 {
+		t.Fatalf("no TLS server in\n%s", b)
+	}
+	// The plain server keeps the headers cleared by proxy.conf.
+	if strings.Contains(blocks[0], "X-SSL-Client") || !strings.Contains(blocks[1], "proxy_set_header X-SSL-Client-Verify $ssl_client_verify;") {
+		t.Errorf("unexpected client certificate headers in\n%s", b)
+	}
+	if !strings.Contains(blocks[1], "ssl_verify_depth 2;") {
+		t.Errorf("no ssl_verify_depth 2 in\n%s", b)
+	}
+	b, err = ioutil.ReadFile(nginxPath + "conf/proxy.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "proxy_set_header X-SSL-Client-Verify \"\";") {
+		t.Errorf("client certificate headers not cleared in\n%s", b)
+	}
+}
+
+func TestRenderGRPC(t *testing.T) {
+	certs = map[string]*x509.Certificate{"a.org": {DNSNames: []string{"a.org"}}}
+	defer func() { certs = nil }()
+	tests := []struct {
+		version  string
+		warnings []string
+	}{
+		{"", []string{"servername: a.org location: / skipped: backend_protocol grpc requires nginx 1.13.10 or later, not 1.11.2 !"}},
+		{"1.13.10", nil},
+	}
+	for _, test := range tests {
+		nginxPath := initTemp(t, InitConf{NginxVersion: test.version})
+		defer os.RemoveAll(nginxPath)
+		config := &Config{
+			Servers: map[string]Server{
+				"a.org": {
+					Locations: map[string]Location{
+						"/": {Upstream: "a_web_web", Path: "/", BackendProtocol: "grpc",
+							AuthRequest: AuthRequest{Proc: "auth.web.web", URI: "/check", Headers: []string{"X-User"}},
+							Headers:     Headers{Request: HeaderRules{Set: map[string]string{"X-Env": "prod"}}}},
+					},
+				},
+			},
+			Upstreams: map[string]Upstream{
+				"a_web_web":    {Protocol: "grpc", Servers: []string{"127.0.0.1:50051"}},
+				"auth_web_web": {Servers: []string{"127.0.0.1:8080"}},
+			},
+		}
+		warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/", HTTPS: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messages(warnings); !reflect.DeepEqual(got, test.warnings) {
+			t.Errorf("%s: warnings %q, want %q", test.version, got, test.warnings)
+		}
+		b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rendered := strings.Contains(string(b), "grpc_pass  grpc://a_web_web;")
+		if rendered != (test.warnings == nil) {
+			t.Errorf("%s: grpc_pass rendered %v in\n%s", test.version, rendered, b)
+		}
+		// grpc_pass passes the headers of the client, proxy.conf cannot clear them.
+		if rendered && !strings.Contains(string(b), "grpc_set_header X-SSL-Client-Verify \"\";") {
+			t.Errorf("%s: client certificate headers not cleared in\n%s", test.version, b)
+		}
+		// grpc_pass ignores proxy_set_header.
+		if rendered && (!strings.Contains(string(b), "grpc_set_header X-User $") || !strings.Contains(string(b), "grpc_set_header X-Env \"prod\";")) {
+			t.Errorf("%s: auth_request or request headers not set with grpc_set_header in\n%s", test.version, b)
+		}
+	}
+}
+
+func TestRenderMirrors(t *testing.T) {
+	tests := []struct {
+		version  string
+		warnings []string
+	}{
+		// The default version, the one of the release image.
+		{"", []string{"servername: a.org location: / mirrors skipped: mirror requires nginx 1.13.4 or later, not 1.11.2 !"}},
+		{"1.13.4", nil},
+	}
+	for _, test := range tests {
+		nginxPath := initTemp(t, InitConf{NginxVersion: test.version})
+		defer os.RemoveAll(nginxPath)
+		config := &Config{
+			Servers: map[string]Server{
+				"a.org": {
+					Locations: map[string]Location{
+						"/": {Upstream: "a_web_web", Path: "/", Mirrors: []Mirror{{Upstream: "a_web_shadow", Percentage: 100}}},
+					},
+				},
+			},
+			Upstreams: map[string]Upstream{
+				"a_web_web":    {Servers: []string{"127.0.0.1:8080"}},
+				"a_web_shadow": {Servers: []string{"127.0.0.1:8081"}},
+			},
+		}
+		warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messages(warnings); !reflect.DeepEqual(got, test.warnings) {
+			t.Errorf("%s: warnings %q, want %q", test.version, got, test.warnings)
+		}
+		b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered := strings.Contains(string(b), "mirror /_webrouter_mirror/"); rendered != (test.warnings == nil) {
+			t.Errorf("%s: mirror rendered %v in\n%s", test.version, rendered, b)
+		}
+	}
+}
+
+func TestRenderCacheBackground(t *testing.T) {
+	tests := []struct {
+		version  string
+		warnings []string
+	}{
+		{"", []string{"servername: a.org location: / cache background skipped: proxy_cache_background_update requires nginx 1.11.10 or later, not 1.11.2 !"}},
+		{"1.11.10", nil},
+	}
+	for _, test := range tests {
+		nginxPath := initTemp(t, InitConf{NginxVersion: test.version})
+		defer os.RemoveAll(nginxPath)
+		config := &Config{
+			Servers: map[string]Server{
+				"a.org": {
+					Locations: map[string]Location{
+						"/": {App: "a", Upstream: "a_web_web", Path: "/", Cache: Cache{Enabled: true, Background: true}},
+					},
+				},
+			},
+			Upstreams: map[string]Upstream{
+				"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+			},
+		}
+		warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/", CachePath: nginxPath + "cache/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := messages(warnings); !reflect.DeepEqual(got, test.warnings) {
+			t.Errorf("%s: warnings %q, want %q", test.version, got, test.warnings)
+		}
+		b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered := strings.Contains(string(b), "proxy_cache_background_update on;"); rendered != (test.warnings == nil) {
+			t.Errorf("%s: proxy_cache_background_update rendered %v in\n%s", test.version, rendered, b)
+		}
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	names := make(map[string]string)
+	for _, location := range []struct{ serverName, uri string }{
+		{"a-b.org", "/"},
+		{"a_b.org", "/"},
+		{"a.org", "x.y"},
+		{"a.org", "x_y"},
+		{"a.org", "=x_y"},
+		{"a.org", "~x.y"},
+		{"*.a.org", "/"},
+		{"_.a.org", "/"},
+	} {
+		name := uniqueName(location.serverName, location.uri)
+		if other, ok := names[name]; ok {
+			t.Errorf("%s %s: name %s already used by %s", location.serverName, location.uri, name, other)
+		}
+		names[name] = location.serverName + " " + location.uri
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_") != "" {
+			t.Errorf("%s %s: name %s is not a word", location.serverName, location.uri, name)
+		}
+	}
+}
+
+func TestRenderBalance(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+
+	// The directive and the upsync_lb method of each upstream, upsync
+	// rebuilds the peers with round robin without upsync_lb.
+	tests := map[string]struct {
+		balance Balance
+		lines   []string
+	}{
+		"round_robin": {Balance{}, nil},
+		"least_conn":  {Balance{Method: "least_conn"}, []string{"    least_conn;", "\tupsync_lb least_conn;"}},
+		"ip_hash":     {Balance{Method: "ip_hash"}, []string{"    ip_hash;", "\tupsync_lb ip_hash;"}},
+		"hash":        {Balance{Method: "hash", Key: "uri"}, []string{"    hash $request_uri;", "\tupsync_lb hash_modula;"}},
+		"consistent":  {Balance{Method: "hash", Key: "header:X-User", Consistent: true}, []string{"    hash $http_x_user consistent;", "\tupsync_lb hash_ketama;"}},
+		"cookie":      {Balance{Method: "cookie"}, []string{"    hash $affinity_cookie consistent;", "\tupsync_lb hash_ketama;"}},
+	}
+	config := &Config{Upstreams: map[string]Upstream{}}
+	for name, test := range tests {
+		config.Upstreams[name] = Upstream{Balance: test.balance, Servers: []string{"127.0.0.1:8080"}}
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("warnings %q", messages(warnings))
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/upstream.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range strings.Split(string(b), "upstream ")[1:] {
+		name := strings.Fields(block)[0]
+		var lines []string
+		for _, line := range strings.Split(block, "\n") {
+			if strings.HasPrefix(line, "    least_conn") || strings.HasPrefix(line, "    ip_hash") ||
+				strings.HasPrefix(line, "    hash ") || strings.HasPrefix(line, "\tupsync_lb ") {
+				lines = append(lines, line)
+			}
+		}
+		if want := tests[name].lines; !reflect.DeepEqual(lines, want) {
+			t.Errorf("%s: %q, want %q", name, lines, want)
+		}
+		delete(tests, name)
+	}
+	if len(tests) > 0 {
+		t.Errorf("upstreams not rendered: %v", tests)
+	}
+}
+
+func TestCertCovers(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"a.org", "*.a.org", "b.org"}}
+	tests := []struct {
+		names  []string
+		covers bool
+	}{
+		{[]string{"a.org"}, true},
+		{[]string{"a.org", "b.org", "www.a.org"}, true},
+		{[]string{"a.org", "c.org"}, false},
+		{[]string{"*.a.org"}, true},
+		{[]string{".a.org"}, true},
+		{[]string{"*.b.org"}, false},
+		{[]string{"www.*"}, false},
+		{[]string{"a.org", `~^api\d+\.a\.org$`}, true},
+		{[]string{`~^api\d+\.a\.org$`}, false},
+	}
+	for _, test := range tests {
+		if got := certCovers(cert, test.names); got != test.covers {
+			t.Errorf("%q: covered %v, want %v", test.names, got, test.covers)
+		}
+	}
+}
+
+func TestRenderServerNames(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"*.a.org": {Aliases: []string{"a.net"}, Locations: map[string]Location{
+				"/": {Upstream: "a_web_web", Path: "/"},
+			}},
+			"b.org": {Aliases: []string{"www.b.org", "b.net"}, RedirectAliases: true, Locations: map[string]Location{
+				"/": {Upstream: "b_web_web", Path: "/"},
+			}},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+			"b_web_web": {Servers: []string{"127.0.0.1:8081"}},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("warnings %q", messages(warnings))
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"server_name  *.a.org a.net;",
+		"access_log  " + nginxPath + "logs/_.a.org___a_web_web.access.log",
+		"server_name  b.org;",
+		"server_name  www.b.org b.net;\n    return 301 $scheme://b.org$request_uri;",
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("no %q in\n%s", s, b)
+		}
+	}
+}
+
+func TestRenderLimits(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {Locations: map[string]Location{
+				"/":   {Upstream: "a_web_web", Path: "/", Limit: Limit{Rate: "10r/s", Burst: 5, NoDelay: true, Key: "header:X-User", Status: 429}},
+				"api": {Upstream: "a_web_web", Path: "api", Limit: Limit{Connections: 10, Exempt: []string{"10.0.0.0/8"}}},
+				"old": {Upstream: "a_web_web", Path: "old", SlashRedirect: true, Limit: Limit{Rate: "1r/s"}},
+			}},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("warnings %q", messages(warnings))
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, api := "limit_"+uniqueName("a.org", "/"), "limit_"+uniqueName("a.org", "api")
+	for _, s := range []string{
+		"limit_req_zone $http_x_user zone=" + root + "_req:20m rate=10r/s;",
+		"limit_req zone=" + root + "_req burst=5 nodelay;\n        limit_req_status 429;",
+		"geo $" + api + "_exempt {\n    default 0;\n    10.0.0.0/8 1;\n}",
+		"map $" + api + "_exempt $" + api + "_key {\n    0 $binary_remote_addr;\n    1 \"\";\n}",
+		"limit_conn_zone $" + api + "_key zone=" + api + "_conn:10m;",
+		"limit_conn " + api + "_conn 10;",
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("no %q in\n%s", s, b)
+		}
+	}
+	// The slash redirects are not limited.
+	if strings.Contains(string(b), "rate=1r/s") {
+		t.Errorf("limit of a slash redirect in\n%s", b)
+	}
+}
+
+func TestRenderAuth(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+	if err := ioutil.WriteFile(nginxPath+"admins.htpasswd", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {Locations: map[string]Location{
+				"/":     {Upstream: "a_web_web", Path: "/", AuthRequest: AuthRequest{Proc: "auth.web.web", URI: "/check", Headers: []string{"X-User"}}},
+				"admin": {Upstream: "a_web_web", Path: "admin", BasicAuth: BasicAuth{File: "admins"}},
+				"ops":   {Upstream: "a_web_web", Path: "ops", BasicAuth: BasicAuth{File: "ops"}},
+			}},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web":    {Servers: []string{"127.0.0.1:8080"}},
+			"auth_web_web": {Servers: []string{"127.0.0.1:8081"}, Protocol: "https"},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/", HtpasswdPath: nginxPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"servername: a.org location: ops skipped: stat " + nginxPath + "ops.htpasswd: no such file or directory"}
+	if got := messages(warnings); !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := "/_webrouter_auth/" + uniqueName("a.org", "/")
+	for _, s := range []string{
+		"auth_basic \"Restricted\";\n        auth_basic_user_file " + nginxPath + "admins.htpasswd;",
+		"auth_request " + auth + ";",
+		"auth_request_set $auth_x_user $upstream_http_x_user;\n        proxy_set_header X-User $auth_x_user;",
+		"location = " + auth + " {\n        internal;\n        proxy_pass_request_body off;",
+		"proxy_pass https://auth_web_web/check;",
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("no %q in\n%s", s, b)
+		}
+	}
+	if strings.Contains(string(b), "/ops/") {
+		t.Errorf("location with a missing htpasswd file in\n%s", b)
+	}
+}
+
+func TestRenderCORS(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {Locations: map[string]Location{
+				"/": {Upstream: "a_web_web", Path: "/", CORS: CORS{Origins: []string{"*"}}},
+				"api": {Upstream: "a_web_web", Path: "api", CORS: CORS{
+					Origins:     []string{"https://b.org", "https://c.org"},
+					Methods:     []string{"GET", "POST"},
+					Headers:     []string{"X-User"},
+					Credentials: true,
+					MaxAge:      600,
+				}},
+			}},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("warnings %q", messages(warnings))
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, api := "$cors_"+uniqueName("a.org", "/"), "$cors_"+uniqueName("a.org", "api")
+	for _, s := range []string{
+		"map $http_origin " + root + " {\n    default \"*\";\n}",
+		"map $http_origin " + api + " {\n    default \"\";\n    \"https://b.org\" $http_origin;\n    \"https://c.org\" $http_origin;\n}",
+		"            add_header Access-Control-Allow-Methods \"GET, POST\" always;\n" +
+			"            add_header Access-Control-Allow-Headers \"X-User\" always;\n" +
+			"            add_header Access-Control-Allow-Credentials true always;\n" +
+			"            add_header Access-Control-Max-Age 600 always;\n" +
+			"            add_header Vary Origin always;\n" +
+			"            return 204;\n        }\n" +
+			"        add_header Access-Control-Allow-Origin " + api + " always;\n" +
+			"        add_header Access-Control-Allow-Credentials true always;\n",
+		// add_header in the location drops the request id of proxy.conf.
+		"        add_header X-Request-Id $webrouter_request_id always;\n        if ($request_method = OPTIONS) {\n            add_header Access-Control-Allow-Origin " + root + " always;",
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("no %q in\n%s", s, b)
+		}
+	}
+}
+
+func TestRenderMaintenance(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{})
+	defer os.RemoveAll(nginxPath)
+	for _, page := range []string{"503.html", "maintenance.html"} {
+		if err := ioutil.WriteFile(nginxPath+page, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {
+				ErrorPages: map[string]string{"503": "503.html", "502": "missing.html"},
+				Locations: map[string]Location{
+					"/":     {Upstream: "a_web_web", Path: "/", Maintenance: Maintenance{Enabled: true, Page: "maintenance.html", RetryAfter: 60}},
+					"api":   {Upstream: "a_web_web", Path: "api", Maintenance: Maintenance{Enabled: true, Body: `{"message":"back soon"}`}},
+					"admin": {Upstream: "a_web_web", Path: "admin", Maintenance: Maintenance{Enabled: true, Page: "missing.html"}},
+				},
+			},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/", ErrorPagePath: nginxPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"servername: a.org error page: 502 skipped: stat " + nginxPath + "missing.html: no such file or directory",
+		"servername: a.org location: admin maintenance page skipped: stat " + nginxPath + "missing.html: no such file or directory",
+	}
+	if got := messages(warnings); !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := "/_webrouter_maintenance/" + uniqueName("a.org", "/")
+	for _, s := range []string{
+		"error_page 503 /_webrouter_errors/503.html;",
+		"location ^~ /_webrouter_errors/ {\n        internal;\n        alias " + nginxPath + ";",
+		"error_page 503 " + page + ";\n        return 503;",
+		"location = " + page + " {\n        internal;\n        add_header Retry-After 60 always;",
+		"alias " + nginxPath + "maintenance.html;",
+		"add_header Retry-After 120 always;\n        add_header X-Request-Id $webrouter_request_id always;\n" +
+			"        default_type application/json;\n        return 503 \"{\\\"message\\\":\\\"back soon\\\"}\";",
+		"default_type application/json;\n        return 503 \"{\\\"message\\\":\\\"service is under maintenance\\\"}\";",
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("no %q in\n%s", s, b)
+		}
+	}
+	if strings.Contains(string(b), "error_page 502") {
+		t.Errorf("missing error page in\n%s", b)
+	}
+}
+
+func TestInitRequestID(t *testing.T) {
+	tests := []struct {
+		header string
+		trust  string
+		lines  []string
+	}{
+		{"", "", []string{
+			"    geo $realip_remote_addr $webrouter_trusted_proxy {\n        default 0;\n        10.0.0.0/8 1;\n    }",
+			"    map \"$webrouter_trusted_proxy:$http_x_request_id\" $webrouter_request_id {",
+			"proxy_set_header X-Request-Id $webrouter_request_id;",
+		}},
+		{"X-Trace-Token", "always", []string{
+			"    map $http_x_trace_token $webrouter_request_id {\n        \"~^(?<id>[A-Za-z0-9._:-]{1,128})$\" $id;",
+			"proxy_set_header X-Trace-Token $webrouter_request_id;\nadd_header X-Trace-Token $webrouter_request_id always;",
+		}},
+		{"", "never", []string{
+			"    map $request_id $webrouter_request_id {\n        default $request_id;\n    }",
+		}},
+	}
+	for _, test := range tests {
+		nginxPath := initTemp(t, InitConf{RealIPFrom: []string{"10.0.0.0/8"}, RequestIDHeader: test.header, RequestIDTrust: test.trust})
+		var confs string
+		for _, name := range []string{"nginx.conf", "proxy.conf"} {
+			b, err := ioutil.ReadFile(nginxPath + "conf/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			confs += string(b)
+		}
+		os.RemoveAll(nginxPath)
+		for _, line := range test.lines {
+			if !strings.Contains(confs, line) {
+				t.Errorf("%s %s: no %q in\n%s", test.header, test.trust, line, confs)
+			}
+		}
+	}
+
+	for _, conf := range []InitConf{
+		{RequestIDHeader: "X Request Id"},
+		{RequestIDTrust: "sometimes"},
+	} {
+		if err := Init(conf); err == nil {
+			t.Errorf("%+v: initialized", conf)
+		}
+	}
+}
+
+func TestInitTracing(t *testing.T) {
+	tests := []struct {
+		tracing string
+		ratio   float64
+		lines   []string
+		absent  []string
+	}{
+		{"", 0, nil, []string{"traceparent", "$webrouter_trace_id"}},
+		{"propagate", 0, []string{
+			"        default \"\";\n    }\n\n    map $http_traceparent $webrouter_parent_span_id {",
+			"' \"$webrouter_trace_id\" \"$webrouter_span_id\"';",
+			"proxy_set_header traceparent $webrouter_traceparent;",
+		}, []string{"split_clients"}},
+		{"generate", 0.25, []string{
+			"        default $request_id;\n    }",
+			"    split_clients $request_id $webrouter_trace_sampled {\n        25% 01;\n        * 00;\n    }",
+			"proxy_set_header traceparent $webrouter_traceparent;",
+		}, nil},
+		{"generate", 1, []string{
+			"    split_clients $request_id $webrouter_trace_sampled {\n        * 01;\n    }",
+		}, nil},
+		{"generate", 0.0005, []string{
+			"        0.05% 01;\n        * 00;",
+		}, nil},
+	}
+	for _, test := range tests {
+		nginxPath := initTemp(t, InitConf{Tracing: test.tracing, TraceSampleRatio: test.ratio})
+		var confs string
+		for _, name := range []string{"nginx.conf", "proxy.conf"} {
+			b, err := ioutil.ReadFile(nginxPath + "conf/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			confs += string(b)
+		}
+		os.RemoveAll(nginxPath)
+		for _, line := range test.lines {
+			if !strings.Contains(confs, line) {
+				t.Errorf("%s %v: no %q in\n%s", test.tracing, test.ratio, line, confs)
+			}
+		}
+		for _, s := range test.absent {
+			if strings.Contains(confs, s) {
+				t.Errorf("%s %v: %q in\n%s", test.tracing, test.ratio, s, confs)
+			}
+		}
+	}
+
+	for _, conf := range []InitConf{
+		{Tracing: "on"},
+		{Tracing: "generate", TraceSampleRatio: 1.5},
+		{Tracing: "generate", TraceSampleRatio: -0.1},
+		{Tracing: "generate", TraceSampleRatio: 0.12345},
+	} {
+		if err := Init(conf); err == nil {
+			t.Errorf("%+v: initialized", conf)
+		}
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	certs = map[string]*x509.Certificate{"a.org": {DNSNames: []string{"a.org"}}}
+	defer func() { certs = nil }()
+	nginxPath := initTemp(t, InitConf{NginxVersion: "1.13.10"})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {Locations: map[string]Location{
+				"/": {App: "a", Upstream: "a_web_web", Path: "/", Cache: Cache{
+					Enabled:  true,
+					ZoneSize: 20,
+					MaxSize:  512,
+					Inactive: "1h",
+					Valid:    map[string]string{"200 302": "10m", "404": "1m"},
+					Key:      []string{"header:Accept-Language", "cookie:lang"},
+					Bypass:   []string{"header:Authorization", "arg:nocache"},
+					Stale:    []string{"error", "timeout"},
+				}},
+				"rpc": {App: "a", Upstream: "a_web_web", Path: "rpc", BackendProtocol: "grpc", Cache: Cache{Enabled: true}},
+			}},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/", HTTPS: true, SSLPath: nginxPath, CachePath: nginxPath + "cache/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"servername: a.org location: rpc skipped: cache requires backend_protocol http or https !"}
+	if got := messages(warnings); !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings %q, want %q", got, want)
+	}
+	if _, err := os.Stat(nginxPath + "cache/a/"); err != nil {
+		t.Error(err)
+	}
+	zone := "cache_" + uniqueName("a.org", "/")
+	b, err := ioutil.ReadFile(nginxPath + "conf/nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := "proxy_cache_path " + nginxPath + "cache/a/" + zone + " levels=1:2 keys_zone=" + zone + ":20m max_size=512m inactive=1h use_temp_path=off;"; !strings.Contains(string(b), s) {
+		t.Errorf("no %q in\n%s", s, b)
+	}
+	b, err = ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := "        proxy_cache " + zone + ";\n" +
+		"        proxy_cache_key \"$scheme$host$request_uri:$http_accept_language:$cookie_lang\";\n" +
+		"        proxy_cache_valid 200 302 10m;\n" +
+		"        proxy_cache_valid 404 1m;\n" +
+		"        proxy_cache_bypass $http_authorization $arg_nocache;\n" +
+		"        proxy_no_cache $http_authorization $arg_nocache;\n" +
+		"        proxy_cache_use_stale error timeout;\n"; !strings.Contains(string(b), s) {
+		t.Errorf("no %q in\n%s", s, b)
+	}
+}
+
+func TestRenderJSONLog(t *testing.T) {
+	nginxPath := initTemp(t, InitConf{LogFormat: "json"})
+	defer os.RemoveAll(nginxPath)
+
+	config := &Config{
+		Servers: map[string]Server{
+			"a.org": {Locations: map[string]Location{
+				"api":       {App: "a", Proc: "a.web.web", Upstream: "a_web_web", Path: "api"},
+				"~v[0-9]+$": {App: "a", Proc: "a.web.web", Upstream: "a_web_web", Path: "v[0-9]+$", Match: "regex"},
+			}},
+		},
+		Upstreams: map[string]Upstream{
+			"a_web_web": {Servers: []string{"127.0.0.1:8080"}},
+		},
+	}
+	warnings, err := Render(config, RenderConf{NginxPath: nginxPath, LogPath: nginxPath + "logs/", LogFormat: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("warnings %q", messages(warnings))
+	}
+	b, err := ioutil.ReadFile(nginxPath + "conf/server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"    location /api/ {\n        set $webrouter_location \"/api/\";\n        set $webrouter_app \"a\";\n        set $webrouter_proc \"a.web.web\";",
+		"set $webrouter_location \"~ ^/v[0-9]+${webrouter_dollar}\";",
+		"access_log  " + nginxPath + "logs/a.org___a_web_web.access.log  json;",
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("no %q in\n%s", s, b)
+		}
+	}
+	// Before 1.11.8 the variables are escaped as \xHH, see accesslog.Parse.
+	b, err = ioutil.ReadFile(nginxPath + "conf/nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "log_format  json '{") || !strings.Contains(string(b), "access_log  "+nginxPath+"logs/access.log  json;") {
+		t.Errorf("no json log format in\n%s", b)
+	}
+}
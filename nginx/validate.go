@@ -0,0 +1,352 @@
+package nginx
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	rateRegexp     = regexp.MustCompile(`^[0-9]+r/[sm]$`)
+	limitKeyRegexp = regexp.MustCompile(`^(ip|header:[A-Za-z0-9-]+|cookie:[A-Za-z0-9_]+)$`)
+	headerRegexp   = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	originRegexp   = regexp.MustCompile(`^(\*|https?://[A-Za-z0-9.-]+(:[0-9]+)?)$`)
+	methodRegexp   = regexp.MustCompile(`^[A-Z]+$`)
+	pageRegexp     = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+	hashKeyRegexp  = regexp.MustCompile(`^(uri|header:[A-Za-z0-9-]+|cookie:[A-Za-z0-9_]+)$`)
+	cookieRegexp   = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	statusRegexp   = regexp.MustCompile(`^(any|[1-5][0-9][0-9]( [1-5][0-9][0-9])*)$`)
+	durationRegexp = regexp.MustCompile(`^[0-9]+[smhd]$`)
+	cacheKeyRegexp = regexp.MustCompile(`^(header:[A-Za-z0-9-]+|cookie:[A-Za-z0-9_]+|arg:[A-Za-z0-9_]+)$`)
+	staleRegexp    = regexp.MustCompile(`^(error|timeout|invalid_header|updating|http_(500|502|503|504|403|404|429))$`)
+	versionRegexp  = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+$`)
+)
+
+const (
+	defaultRetryAfter      = 120
+	defaultMaintenanceBody = `{"message":"service is under maintenance"}`
+	defaultAffinityCookie  = "webrouter_affinity"
+	defaultVerifyDepth     = 2
+	// defaultNginxVersion is the nginx of the release image in lain.yaml.
+	defaultNginxVersion = "1.11.2"
+)
+
+// Validate checks the options of a location which do not depend on the rest
+// of the config, the certificates or the files on disk.
+func (l Location) Validate() error {
+	switch l.Match {
+	case "", "prefix", "exact", "regex":
+	default:
+		return errors.New("location_match: " + l.Match + " must be prefix, exact or regex !")
+	}
+	switch l.BarePath {
+	case "", "redirect", "match":
+	default:
+		return errors.New("bare_path: " + l.BarePath + " must be redirect or match !")
+	}
+	if l.KeepPrefix && l.ReplacePrefix != "" {
+		return errors.New("keep_prefix and replace_prefix are exclusive !")
+	}
+	if l.ReplacePrefix != "" && !strings.HasPrefix(l.ReplacePrefix, "/") {
+		return errors.New("replace_prefix: " + l.ReplacePrefix + " must start with / !")
+	}
+	switch l.ClientAuth.Verify {
+	case "":
+	case "on", "optional":
+		if l.ClientAuth.CA == "" {
+			return errors.New("client_auth ca is empty !")
+		}
+		if l.ClientAuth.Depth < 0 || l.ClientAuth.Depth > 10 {
+			return errors.New("client_auth depth: " + strconv.Itoa(l.ClientAuth.Depth) + " must be between 0 and 10 !")
+		}
+	default:
+		return errors.New("client_auth verify: " + l.ClientAuth.Verify + " must be on or optional !")
+	}
+	switch l.BackendProtocol {
+	case "", "http", "https", "grpc", "grpcs":
+	default:
+		return errors.New("backend_protocol: " + l.BackendProtocol + " must be http, https, grpc or grpcs !")
+	}
+	if l.BackendProtocol != "https" && l.BackendProtocol != "grpcs" && l.BackendTLS != (BackendTLS{}) {
+		return errors.New("backend_tls requires backend_protocol https or grpcs !")
+	}
+	if err := l.Limit.validate(); err != nil {
+		return err
+	}
+	if l.AuthRequest.Proc != "" {
+		if !strings.HasPrefix(l.AuthRequest.URI, "/") {
+			return errors.New("auth_request uri: " + l.AuthRequest.URI + " must start with / !")
+		}
+		for _, header := range l.AuthRequest.Headers {
+			if !headerRegexp.MatchString(header) {
+				return errors.New("auth_request header: " + header + " is invalid !")
+			}
+		}
+	}
+	if err := l.Headers.Request.validate(); err != nil {
+		return errors.New("request " + err.Error())
+	}
+	if err := l.Headers.Response.validate(); err != nil {
+		return errors.New("response " + err.Error())
+	}
+	if err := l.CORS.validate(); err != nil {
+		return err
+	}
+	for _, redirect := range l.Redirects {
+		if err := redirect.validate(); err != nil {
+			return err
+		}
+	}
+	for _, mirror := range l.Mirrors {
+		if mirror.Upstream == "" {
+			return errors.New("mirror upstream is empty !")
+		}
+		if mirror.Percentage < 1 || mirror.Percentage > 100 {
+			return errors.New("mirror: " + mirror.Upstream + " percentage: " + strconv.Itoa(mirror.Percentage) +
+				" must be between 1 and 100 !")
+		}
+	}
+	if err := l.Cache.validate(); err != nil {
+		return err
+	}
+	return l.Maintenance.Validate()
+}
+
+func (c Cache) validate() error {
+	if c.ZoneSize < 0 || c.MaxSize < 0 {
+		return errors.New("cache zone_size and max_size must not be negative !")
+	}
+	if c.Inactive != "" && !durationRegexp.MatchString(c.Inactive) {
+		return errors.New("cache inactive: " + c.Inactive + " must be like 10m !")
+	}
+	for status, ttl := range c.Valid {
+		if !statusRegexp.MatchString(status) {
+			return errors.New("cache valid status: " + status + " must be like 200 302 or any !")
+		}
+		if !durationRegexp.MatchString(ttl) {
+			return errors.New("cache valid: " + ttl + " must be like 10m !")
+		}
+	}
+	for _, key := range c.Key {
+		if strings.HasPrefix(key, "arg:") || !cacheKeyRegexp.MatchString(key) {
+			return errors.New("cache key: " + key + " must be header:<name> or cookie:<name> !")
+		}
+	}
+	for _, bypass := range c.Bypass {
+		if !cacheKeyRegexp.MatchString(bypass) {
+			return errors.New("cache bypass: " + bypass + " must be header:<name>, cookie:<name> or arg:<name> !")
+		}
+	}
+	for _, stale := range c.Stale {
+		if !staleRegexp.MatchString(stale) {
+			return errors.New("cache stale: " + stale + " is invalid !")
+		}
+	}
+	return nil
+}
+
+// Validate checks a maintenance response.
+func (m Maintenance) Validate() error {
+	if m.Page != "" && (!pageRegexp.MatchString(m.Page) || strings.Contains(m.Page, "..")) {
+		return errors.New("maintenance page: " + m.Page + " is invalid !")
+	}
+	if m.Body != "" {
+		if !json.Valid([]byte(m.Body)) {
+			return errors.New("maintenance body is not valid JSON !")
+		}
+		if strings.Contains(m.Body, "$") {
+			return errors.New("maintenance body must not contain $ !")
+		}
+	}
+	if m.RetryAfter < 0 {
+		return errors.New("maintenance retry_after must not be negative !")
+	}
+	return nil
+}
+
+// Validate checks a load balancing method.
+func (b Balance) Validate() error {
+	switch b.Method {
+	case "", "round_robin", "least_conn", "ip_hash":
+	case "hash":
+		if !hashKeyRegexp.MatchString(b.Key) {
+			return errors.New("load_balance key: " + b.Key + " must be uri, header:<name> or cookie:<name> !")
+		}
+	case "cookie":
+		if b.Cookie != "" && !cookieRegexp.MatchString(b.Cookie) {
+			return errors.New("load_balance cookie: " + b.Cookie + " is invalid !")
+		}
+		if b.MaxAge < 0 {
+			return errors.New("load_balance max_age must not be negative !")
+		}
+	default:
+		return errors.New("load_balance method: " + b.Method +
+			" must be round_robin, least_conn, ip_hash, hash or cookie !")
+	}
+	return nil
+}
+
+// ValidateErrorPages checks the custom error pages of a server, which are
+// keyed by status code.
+func ValidateErrorPages(pages map[string]string) error {
+	for code, page := range pages {
+		switch code {
+		case "502", "503", "504":
+		default:
+			return errors.New("error page code: " + code + " must be 502, 503 or 504 !")
+		}
+		if !pageRegexp.MatchString(page) || strings.Contains(page, "..") {
+			return errors.New("error page: " + page + " is invalid !")
+		}
+	}
+	return nil
+}
+
+func (r Redirect) validate() error {
+	if r.Match == "" {
+		return errors.New("redirect match is empty !")
+	}
+	if strings.ContainsAny(r.Match+r.Target, "\r\n") {
+		return errors.New("redirect: " + r.Match + " contains a line break !")
+	}
+	switch r.Status {
+	case 0:
+		if !strings.HasPrefix(r.Target, "/") {
+			return errors.New("rewrite: " + r.Match + " target: " + r.Target + " must start with / !")
+		}
+	case 301, 302, 303, 307, 308:
+		if !strings.HasPrefix(r.Target, "/") && !strings.HasPrefix(r.Target, "http://") &&
+			!strings.HasPrefix(r.Target, "https://") {
+			return errors.New("redirect: " + r.Match + " target: " + r.Target + " must be a path or an http(s) URL !")
+		}
+	default:
+		return errors.New("redirect: " + r.Match + " status: " + strconv.Itoa(r.Status) +
+			" must be 301, 302, 303, 307 or 308 !")
+	}
+	return nil
+}
+
+func (l Limit) validate() error {
+	if l.Rate != "" && !rateRegexp.MatchString(l.Rate) {
+		return errors.New("limit rate: " + l.Rate + " must be like 10r/s or 60r/m !")
+	}
+	if l.Key != "" && !limitKeyRegexp.MatchString(l.Key) {
+		return errors.New("limit key: " + l.Key + " must be ip, header:<name> or cookie:<name> !")
+	}
+	if l.Burst < 0 || l.Connections < 0 || l.ZoneSize < 0 {
+		return errors.New("limit burst, connections and zone_size must not be negative !")
+	}
+	if l.Status != 0 && (l.Status < 400 || l.Status > 599) {
+		return errors.New("limit status: " + strconv.Itoa(l.Status) + " must be between 400 and 599 !")
+	}
+	for _, cidr := range l.Exempt {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return errors.New("limit exempt: " + cidr + " is not a CIDR !")
+		}
+	}
+	return nil
+}
+
+func (h HeaderRules) validate() error {
+	var names []string
+	for name, value := range h.Add {
+		names = append(names, name)
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("headers: " + name + " value contains a line break !")
+		}
+	}
+	for name, value := range h.Set {
+		names = append(names, name)
+		if strings.ContainsAny(value, "\r\n") {
+			return errors.New("headers: " + name + " value contains a line break !")
+		}
+	}
+	for _, name := range append(names, h.Remove...) {
+		if !headerRegexp.MatchString(name) {
+			return errors.New("headers: " + name + " is not a valid header name !")
+		}
+	}
+	return nil
+}
+
+func (c CORS) validate() error {
+	for _, origin := range c.Origins {
+		if !originRegexp.MatchString(origin) {
+			return errors.New("cors origin: " + origin + " must be * or like https://example.com !")
+		}
+	}
+	// Any origin would be reflected with credentials, letting every site
+	// read the responses with the cookies of the users.
+	if c.Credentials && c.AnyOrigin() {
+		return errors.New("cors origin: * cannot be allowed with credentials !")
+	}
+	for _, method := range c.Methods {
+		if !methodRegexp.MatchString(method) {
+			return errors.New("cors method: " + method + " is invalid !")
+		}
+	}
+	for _, header := range c.Headers {
+		if !headerRegexp.MatchString(header) {
+			return errors.New("cors header: " + header + " is invalid !")
+		}
+	}
+	return nil
+}
+
+// Validate checks a stream declaration. Protocol defaults to tcp.
+func (s Stream) Validate() error {
+	port := strconv.Itoa(s.Port)
+	if s.Port < 1 || s.Port > 65535 {
+		return errors.New("stream port: " + port + " is invalid !")
+	}
+	if s.Protocol != "" && s.Protocol != "tcp" && s.Protocol != "udp" {
+		return errors.New("stream port: " + port + " protocol: " + s.Protocol + " must be tcp or udp !")
+	}
+	tcp := s.Protocol == "" || s.Protocol == "tcp"
+	if tcp && (s.Port == 80 || s.Port == 443) {
+		return errors.New("stream port: " + port + " is reserved for http !")
+	}
+	switch s.TLS {
+	case "":
+	case "terminate", "passthrough":
+		if !tcp {
+			return errors.New("stream port: " + port + " tls " + s.TLS + " requires protocol tcp !")
+		}
+		if s.ServerName == "" {
+			return errors.New("stream port: " + port + " tls " + s.TLS + " requires server_name !")
+		}
+	default:
+		return errors.New("stream port: " + port + " tls: " + s.TLS + " must be terminate or passthrough !")
+	}
+	return nil
+}
+
+func validateLocations(config *Config, d *dropped) {
+	for serverName, server := range config.Servers {
+		if err := ValidateErrorPages(server.ErrorPages); err != nil {
+			server.ErrorPages = nil
+			config.Servers[serverName] = server
+			d.warn(errors.New("servername: " + serverName + " error pages skipped: " + err.Error()))
+		}
+		for uri, location := range server.Locations {
+			if err := location.Validate(); err != nil {
+				d.location(config, serverName, uri, err)
+			}
+		}
+	}
+}
+
+// validateUpstreams falls back to round robin for the upstreams with an
+// invalid balance.
+func validateUpstreams(config *Config, d *dropped) {
+	for name, upstream := range config.Upstreams {
+		if err := upstream.Balance.Validate(); err != nil {
+			upstream.Balance = Balance{}
+			config.Upstreams[name] = upstream
+			d.warn(errors.New("upstream: " + name + " balance skipped: " + err.Error()))
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package nginx
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCORSValidate(t *testing.T) {
+	tests := []struct {
+		cors  CORS
+		valid bool
+	}{
+		{CORS{Origins: []string{"*"}}, true},
+		{CORS{Origins: []string{"https://a.org", "http://b.org:8080"}, Credentials: true}, true},
+		{CORS{Origins: []string{"*"}, Credentials: true}, false},
+		{CORS{Origins: []string{"https://a.org", "*"}, Credentials: true}, false},
+		{CORS{Origins: []string{"a.org"}}, false},
+		{CORS{Origins: []string{"https://a.org"}, Methods: []string{"get"}}, false},
+		{CORS{Origins: []string{"https://a.org"}, Headers: []string{"X-A B"}}, false},
+	}
+	for _, test := range tests {
+		err := Location{CORS: test.cors}.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.cors, err, test.valid)
+		}
+	}
+}
+
+func TestClientAuthValidate(t *testing.T) {
+	tests := []struct {
+		depth int
+		err   string
+	}{
+		{-1, "client_auth depth: -1 must be between 0 and 10 !"},
+		{0, ""},
+		{1, ""},
+		{10, ""},
+		{11, "client_auth depth: 11 must be between 0 and 10 !"},
+	}
+	for _, test := range tests {
+		err := Location{ClientAuth: ClientAuth{Verify: "on", CA: "ca", Depth: test.depth}}.Validate()
+		if got := fmt.Sprint(err); err != nil && got != test.err || err == nil && test.err != "" {
+			t.Errorf("depth %d: got %v, want %q", test.depth, err, test.err)
+		}
+	}
+}
+
+func TestLimitValidate(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		valid bool
+	}{
+		{Limit{Rate: "10r/s", Burst: 20, NoDelay: true}, true},
+		{Limit{Rate: "60r/m", Key: "header:X-User", Status: 429}, true},
+		{Limit{Connections: 10, Key: "cookie:session", Exempt: []string{"10.0.0.0/8", "192.168.1.1"}}, true},
+		{Limit{Rate: "10r/h"}, false},
+		{Limit{Rate: "10r/s", Key: "uri"}, false},
+		{Limit{Rate: "10r/s", Burst: -1}, false},
+		{Limit{Connections: -1}, false},
+		{Limit{Rate: "10r/s", ZoneSize: -1}, false},
+		{Limit{Rate: "10r/s", Status: 200}, false},
+		{Limit{Rate: "10r/s", Status: 600}, false},
+		{Limit{Rate: "10r/s", Exempt: []string{"office"}}, false},
+	}
+	for _, test := range tests {
+		err := Location{Limit: test.limit}.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.limit, err, test.valid)
+		}
+	}
+}
+
+func TestAuthRequestValidate(t *testing.T) {
+	tests := []struct {
+		auth  AuthRequest
+		valid bool
+	}{
+		{AuthRequest{Proc: "auth.web.web", URI: "/check", Headers: []string{"X-User", "X-Roles"}}, true},
+		{AuthRequest{Proc: "auth.web.web", URI: "check"}, false},
+		{AuthRequest{Proc: "auth.web.web", URI: "/check", Headers: []string{"X User"}}, false},
+		{AuthRequest{Proc: "auth.web.web", URI: "/check", Headers: []string{"X-User\r\nX-Admin: 1"}}, false},
+	}
+	for _, test := range tests {
+		err := Location{AuthRequest: test.auth}.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.auth, err, test.valid)
+		}
+	}
+}
+
+func TestHeadersValidate(t *testing.T) {
+	tests := []struct {
+		headers Headers
+		valid   bool
+	}{
+		{Headers{Request: HeaderRules{Add: map[string]string{"X-Env": "prod"}, Remove: []string{"Cookie"}}}, true},
+		{Headers{Response: HeaderRules{Set: map[string]string{"Cache-Control": "no-store"}}}, true},
+		{Headers{Request: HeaderRules{Set: map[string]string{"X-Env": "prod\r\nX-Admin: 1"}}}, false},
+		{Headers{Response: HeaderRules{Add: map[string]string{"X Env": "prod"}}}, false},
+		{Headers{Response: HeaderRules{Remove: []string{"Server;"}}}, false},
+	}
+	for _, test := range tests {
+		err := Location{Headers: test.headers}.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.headers, err, test.valid)
+		}
+	}
+}
+
+func TestMaintenanceValidate(t *testing.T) {
+	tests := []struct {
+		maintenance Maintenance
+		valid       bool
+	}{
+		{Maintenance{}, true},
+		{Maintenance{Page: "maintenance.html", RetryAfter: 60}, true},
+		{Maintenance{Body: `{"message":"back soon"}`}, true},
+		{Maintenance{Page: "../nginx.conf"}, false},
+		{Maintenance{Page: "a/b.html"}, false},
+		{Maintenance{Body: "back soon"}, false},
+		{Maintenance{Body: `{"host":"$host"}`}, false},
+		{Maintenance{RetryAfter: -1}, false},
+	}
+	for _, test := range tests {
+		err := test.maintenance.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.maintenance, err, test.valid)
+		}
+	}
+}
+
+func TestCacheValidate(t *testing.T) {
+	tests := []struct {
+		cache Cache
+		valid bool
+	}{
+		{Cache{Enabled: true}, true},
+		{Cache{Enabled: true, Inactive: "1h", Valid: map[string]string{"200 302": "10m", "any": "1m"}}, true},
+		{Cache{Enabled: true, Key: []string{"header:Accept-Language"}, Bypass: []string{"arg:nocache"}, Stale: []string{"updating", "http_503"}}, true},
+		{Cache{Enabled: true, ZoneSize: -1}, false},
+		{Cache{Enabled: true, Inactive: "1 hour"}, false},
+		{Cache{Enabled: true, Valid: map[string]string{"2xx": "10m"}}, false},
+		{Cache{Enabled: true, Valid: map[string]string{"200": "forever"}}, false},
+		{Cache{Enabled: true, Key: []string{"arg:page"}}, false},
+		{Cache{Enabled: true, Bypass: []string{"uri"}}, false},
+		{Cache{Enabled: true, Stale: []string{"http_418"}}, false},
+	}
+	for _, test := range tests {
+		err := Location{Cache: test.cache}.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %v", test.cache, err, test.valid)
+		}
+	}
+}
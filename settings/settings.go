@@ -0,0 +1,179 @@
+// Package settings loads the settings of the rendered nginx configs from the
+// environment variables, so that the watcher and webrouterctl render the same
+// configs.
+package settings
+
+import (
+	"errors"
+	"github.com/laincloud/webrouter/nginx"
+	"github.com/spf13/viper"
+	"net"
+	"strings"
+)
+
+// Load binds the environment variables of the rendered configs to viper, with
+// their defaults, and returns the confs of nginx.Init and nginx.Render. Values
+// set with viper.Set before take precedence. REAL_IP_FROM and IP_LISTS must
+// only hold IPs and CIDRs.
+func Load() (nginx.InitConf, nginx.RenderConf, error) {
+	viper.SetDefault("consul", "consul.lain:8500")
+	viper.SetDefault("nginx", "/usr/local/openresty/nginx/")
+	viper.SetDefault("pid", "/var/run/nginx.pid")
+	viper.SetDefault("log", "/var/log/nginx/")
+	viper.SetDefault("ssl", "/etc/nginx/ssl/")
+	viper.SetDefault("htpasswd", "/etc/nginx/htpasswd/")
+	viper.SetDefault("errorPages", "/etc/nginx/error_pages/")
+	viper.SetDefault("cache", "/var/cache/nginx/webrouter/")
+	viper.SetDefault("logFormat", "main")
+	viper.SetDefault("locationLogs", true)
+	viper.SetDefault("requestIDHeader", "X-Request-Id")
+	viper.SetDefault("requestIDTrust", "trusted")
+	viper.SetDefault("tracing", "off")
+	viper.SetDefault("traceSampleRatio", 1)
+	viper.SetDefault("serverName", "localhost")
+	viper.SetDefault("prefix", "lain/webrouter/upstreams/")
+	viper.SetDefault("https", false)
+	viper.SetDefault("serverNamesHashMaxSize", 512)
+	viper.SetDefault("serverNamesHashBucketSize", 64)
+	viper.SetDefault("checkShmSize", 1)
+	viper.SetDefault("realIPFrom", "10.0.0.0/8,172.20.0.0/16")
+	viper.SetDefault("ipLists", "")
+	viper.SetDefault("ABTest", false)
+	viper.SetDefault("redisRole", "master")
+	viper.SetDefault("redisDBID", 0)
+	viper.SetDefault("redisConnectTimeout", 100)
+	viper.SetDefault("redisReadTimeout", 1000)
+	viper.SetDefault("redisKeepaliveTimeout", 60000)
+	viper.SetDefault("redisPoolSize", 30)
+
+	viper.BindEnv("consul", "CONSUL_ADDR")
+	viper.BindEnv("nginx", "NGINX_PATH")
+	viper.BindEnv("nginxVersion", "NGINX_VERSION")
+	viper.BindEnv("pid", "NGINX_PID_PATH")
+	viper.BindEnv("log", "NGINX_LOG_PATH")
+	viper.BindEnv("ssl", "NGINX_SSL_PATH")
+	viper.BindEnv("htpasswd", "NGINX_HTPASSWD_PATH")
+	viper.BindEnv("errorPages", "NGINX_ERROR_PAGE_PATH")
+	viper.BindEnv("cache", "NGINX_CACHE_PATH")
+	viper.BindEnv("logFormat", "NGINX_LOG_FORMAT")
+	viper.BindEnv("locationLogs", "NGINX_LOCATION_LOGS")
+	viper.BindEnv("requestIDHeader", "REQUEST_ID_HEADER")
+	viper.BindEnv("requestIDTrust", "REQUEST_ID_TRUST")
+	viper.BindEnv("tracing", "TRACING")
+	viper.BindEnv("traceSampleRatio", "TRACE_SAMPLE_RATIO")
+	viper.BindEnv("serverName", "NGINX_SERVER_NAME")
+	viper.BindEnv("prefix", "CONSUL_KEY_PREFIX")
+	viper.BindEnv("https", "HTTPS")
+	viper.BindEnv("serverNamesHashMaxSize", "SERVER_NAMES_HASH_MAX_SIZE")
+	viper.BindEnv("serverNamesHashBucketSize", "SERVER_NAMES_HASH_BUCKET_SIZE")
+	viper.BindEnv("checkShmSize", "CHECK_SHM_SIZE")
+	viper.BindEnv("realIPFrom", "REAL_IP_FROM")
+	viper.BindEnv("ipLists", "IP_LISTS")
+	viper.BindEnv("ABTest", "AB_TEST")
+	viper.BindEnv("redisSentinel", "REDIS_SENTINEL")
+	viper.BindEnv("redisMasterName", "REDIS_MASTER_NAME")
+	viper.BindEnv("redisRole", "REDIS_ROLE")
+	viper.BindEnv("redisPassword", "REDIS_PASSWORD")
+	viper.BindEnv("redisConnectTimeout", "REDIS_CONNECT_TIMEOUT")
+	viper.BindEnv("redisReadTimeout", "REDIS_READ_TIMEOUT")
+	viper.BindEnv("redisDBID", "REDIS_DBID")
+	viper.BindEnv("redisPoolSize", "REDIS_POOL_SIZE")
+	viper.BindEnv("redisKeepaliveTimeout", "REDIS_KEEPALIVE_TIMEOUT")
+
+	realIPFrom, err := ParseCIDRs(viper.GetString("realIPFrom"))
+	if err != nil {
+		return nginx.InitConf{}, nginx.RenderConf{}, errors.New("REAL_IP_FROM " + err.Error())
+	}
+	ipLists, err := ParseIPLists(viper.GetString("ipLists"))
+	if err != nil {
+		return nginx.InitConf{}, nginx.RenderConf{}, errors.New("IP_LISTS " + err.Error())
+	}
+
+	redisConf := nginx.RedisConf{
+		Sentinel:         viper.GetString("redisSentinel"),
+		MasterName:       viper.GetString("redisMasterName"),
+		Role:             viper.GetString("redisRole"),
+		Password:         viper.GetString("redisPassword"),
+		ConnectTimeout:   viper.GetInt("redisConnectTimeout"),
+		ReadTimeout:      viper.GetInt("redisReadTimeout"),
+		DBID:             viper.GetInt("redisDBID"),
+		PoolSize:         viper.GetInt("redisPoolSize"),
+		KeepaliveTimeout: viper.GetInt("redisKeepaliveTimeout"),
+	}
+
+	initConf := nginx.InitConf{
+		NginxPath:                 viper.GetString("nginx"),
+		NginxVersion:              viper.GetString("nginxVersion"),
+		LogPath:                   viper.GetString("log"),
+		ServerName:                viper.GetString("serverName"),
+		PidPath:                   viper.GetString("pid"),
+		HTTPS:                     viper.GetBool("https"),
+		SSLPath:                   viper.GetString("ssl"),
+		ServerNamesHashMaxSize:    viper.GetInt("serverNamesHashMaxSize"),
+		ServerNamesHashBucketSize: viper.GetInt("serverNamesHashBucketSize"),
+		CheckShmSize:              viper.GetInt("checkShmSize"),
+		RealIPFrom:                realIPFrom,
+		LogFormat:                 viper.GetString("logFormat"),
+		RequestIDHeader:           viper.GetString("requestIDHeader"),
+		RequestIDTrust:            viper.GetString("requestIDTrust"),
+		Tracing:                   viper.GetString("tracing"),
+		TraceSampleRatio:          viper.GetFloat64("traceSampleRatio"),
+		ABTest:                    viper.GetBool("ABTest"),
+		RedisConf:                 redisConf,
+	}
+
+	renderConf := nginx.RenderConf{
+		NginxPath:     viper.GetString("nginx"),
+		LogPath:       viper.GetString("log"),
+		HTTPS:         viper.GetBool("https"),
+		SSLPath:       viper.GetString("ssl"),
+		ConsulAddr:    viper.GetString("consul"),
+		ConsulPrefix:  viper.GetString("prefix"),
+		IPLists:       ipLists,
+		HtpasswdPath:  viper.GetString("htpasswd"),
+		ErrorPagePath: viper.GetString("errorPages"),
+		CachePath:     viper.GetString("cache"),
+		LogFormat:     viper.GetString("logFormat"),
+		NoLocationLog: !viper.GetBool("locationLogs"),
+		ABTest:        viper.GetBool("ABTest"),
+		RedisConf:     redisConf,
+	}
+	return initConf, renderConf, nil
+}
+
+// ParseCIDRs parses a comma separated list of IPs and CIDRs, empty entries
+// are skipped.
+func ParseCIDRs(s string) ([]string, error) {
+	var cidrs []string
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return nil, errors.New("entry: " + cidr + " is neither an IP nor a CIDR !")
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// ParseIPLists parses named IP lists like "office=10.1.0.0/16,10.2.0.0/16;vpn=172.16.0.0/12".
+func ParseIPLists(s string) (map[string][]string, error) {
+	ipLists := make(map[string][]string)
+	for _, list := range strings.Split(s, ";") {
+		if list = strings.TrimSpace(list); list == "" {
+			continue
+		}
+		fields := strings.SplitN(list, "=", 2)
+		name := strings.TrimSpace(fields[0])
+		if len(fields) != 2 || name == "" {
+			return nil, errors.New("list: " + list + " must be like name=10.1.0.0/16,10.2.0.0/16 !")
+		}
+		cidrs, err := ParseCIDRs(fields[1])
+		if err != nil {
+			return nil, errors.New("list: " + name + " " + err.Error())
+		}
+		ipLists[name] = cidrs
+	}
+	return ipLists, nil
+}
@@ -0,0 +1,73 @@
+package settings
+
+import (
+	"github.com/spf13/viper"
+	"reflect"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		s     string
+		cidrs []string
+		err   string
+	}{
+		{"", nil, ""},
+		{" , ", nil, ""},
+		{"10.0.0.0/8, 172.20.0.1,,::1", []string{"10.0.0.0/8", "172.20.0.1", "::1"}, ""},
+		{"10.0.0.0/8,office", nil, "entry: office is neither an IP nor a CIDR !"},
+		{"10.0.0.0/33", nil, "entry: 10.0.0.0/33 is neither an IP nor a CIDR !"},
+	}
+	for _, test := range tests {
+		cidrs, err := ParseCIDRs(test.s)
+		if !reflect.DeepEqual(cidrs, test.cidrs) || err == nil && test.err != "" || err != nil && err.Error() != test.err {
+			t.Errorf("%q: %q %v, want %q %q", test.s, cidrs, err, test.cidrs, test.err)
+		}
+	}
+}
+
+func TestParseIPLists(t *testing.T) {
+	tests := []struct {
+		s       string
+		ipLists map[string][]string
+		err     string
+	}{
+		{"", map[string][]string{}, ""},
+		{" office = 10.1.0.0/16, 10.2.0.0/16 ; vpn=172.16.0.0/12;", map[string][]string{
+			"office": {"10.1.0.0/16", "10.2.0.0/16"},
+			"vpn":    {"172.16.0.0/12"},
+		}, ""},
+		{"office", nil, "list: office must be like name=10.1.0.0/16,10.2.0.0/16 !"},
+		{"=10.1.0.0/16", nil, "list: =10.1.0.0/16 must be like name=10.1.0.0/16,10.2.0.0/16 !"},
+		{"office=10.1.0.0/16,vpn", nil, "list: office entry: vpn is neither an IP nor a CIDR !"},
+	}
+	for _, test := range tests {
+		ipLists, err := ParseIPLists(test.s)
+		if !reflect.DeepEqual(ipLists, test.ipLists) || err == nil && test.err != "" || err != nil && err.Error() != test.err {
+			t.Errorf("%q: %v %v, want %v %q", test.s, ipLists, err, test.ipLists, test.err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	defer viper.Reset()
+
+	viper.Set("realIPFrom", " , ")
+	initConf, renderConf, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(initConf.RealIPFrom) > 0 || len(renderConf.IPLists) > 0 {
+		t.Errorf("real ip from %q, ip lists %v without entries", initConf.RealIPFrom, renderConf.IPLists)
+	}
+
+	viper.Set("realIPFrom", "10.0.0.0/8,lb")
+	if _, _, err := Load(); err == nil || err.Error() != "REAL_IP_FROM entry: lb is neither an IP nor a CIDR !" {
+		t.Errorf("invalid REAL_IP_FROM: %v", err)
+	}
+	viper.Set("realIPFrom", "10.0.0.0/8")
+	viper.Set("ipLists", "office=10.1.0.0/16,vpn")
+	if _, _, err := Load(); err == nil || err.Error() != "IP_LISTS list: office entry: vpn is neither an IP nor a CIDR !" {
+		t.Errorf("invalid IP_LISTS: %v", err)
+	}
+}
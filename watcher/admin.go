@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/laincloud/webrouter/nginx"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// admin serves the watcher admin API, on 127.0.0.1:9090 by default as it is
+// not authenticated. Maintenance toggled through it is kept in memory and
+// applied to every config before it is rendered, on top of the maintenance
+// declared in the annotations.
+//
+//	GET    /maintenance        list the apps put under maintenance
+//	PUT    /maintenance/<app>  put an app under maintenance, with an optional
+//	                           JSON body like the maintenance annotation
+//	DELETE /maintenance/<app>  end the maintenance of an app
+//	DELETE /cache/<app>        purge the cached responses of an app
+//	GET    /metrics            access log metrics, if the analyzer runs, also
+//	                           served on PROMETHEUS_ADDR for remote scrapers
+//	GET    /config             the config last rendered, as JSON with the
+//	                           zones, variables and locations set when
+//	                           rendering
+type admin struct {
+	sync.Mutex
+	maintenance   map[string]nginx.Maintenance
+	changed       chan struct{}
+	cachePath     string
+	errorPagePath string
+	metrics       http.Handler
+	config        []byte
+}
+
+var appRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+func newAdmin(cachePath, errorPagePath string) *admin {
+	return &admin{
+		maintenance:   make(map[string]nginx.Maintenance),
+		changed:       make(chan struct{}, 1),
+		cachePath:     cachePath,
+		errorPagePath: errorPagePath,
+	}
+}
+
+// apply enables the maintenance of the locations of the apps under
+// maintenance. Page, body and retry after default to the annotation ones.
+func (a *admin) apply(config *nginx.Config) {
+	a.Lock()
+	defer a.Unlock()
+	for _, server := range config.Servers {
+		for key, location := range server.Locations {
+			maintenance, ok := a.maintenance[location.App]
+			if !ok {
+				continue
+			}
+			if maintenance.Page == "" && maintenance.Body == "" {
+				maintenance.Page = location.Maintenance.Page
+				maintenance.Body = location.Maintenance.Body
+			}
+			if maintenance.RetryAfter == 0 {
+				maintenance.RetryAfter = location.Maintenance.RetryAfter
+			}
+			maintenance.Enabled = true
+			location.Maintenance = maintenance
+			server.Locations[key] = location
+		}
+	}
+}
+
+// setConfig keeps the config last rendered for GET /config.
+func (a *admin) setConfig(config nginx.Config) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	a.Lock()
+	a.config = b
+	a.Unlock()
+}
+
+func (a *admin) notify() {
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (a *admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/maintenance" && r.Method == http.MethodGet {
+		a.Lock()
+		defer a.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.maintenance)
+		return
+	}
+	if r.URL.Path == "/config" && r.Method == http.MethodGet {
+		a.Lock()
+		defer a.Unlock()
+		if a.config == nil {
+			http.Error(w, "no config rendered yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(a.config)
+		return
+	}
+	if r.URL.Path == "/metrics" && a.metrics != nil {
+		a.metrics.ServeHTTP(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/cache/") {
+		a.serveCache(w, r, strings.TrimPrefix(r.URL.Path, "/cache/"))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/maintenance/") {
+		http.NotFound(w, r)
+		return
+	}
+	app := strings.TrimPrefix(r.URL.Path, "/maintenance/")
+	if app == "" || strings.Contains(app, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		var maintenance nginx.Maintenance
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &maintenance); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := maintenance.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if maintenance.Page != "" {
+			if _, err := os.Stat(a.errorPagePath + maintenance.Page); err != nil {
+				http.Error(w, "maintenance page: "+maintenance.Page+" does not exist !", http.StatusBadRequest)
+				return
+			}
+		}
+		maintenance.Enabled = true
+		a.Lock()
+		a.maintenance[app] = maintenance
+		a.Unlock()
+		log.WithField("app", app).Infoln("maintenance enabled")
+	case http.MethodDelete:
+		a.Lock()
+		delete(a.maintenance, app)
+		a.Unlock()
+		log.WithField("app", app).Infoln("maintenance disabled")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveCache purges the cache of an app by emptying its zone directories,
+// nginx treats the removed responses as misses.
+func (a *admin) serveCache(w http.ResponseWriter, r *http.Request, app string) {
+	if !appRegexp.MatchString(app) || strings.Contains(app, "..") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := nginx.CacheDir(a.cachePath, app)
+	zones, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, zone := range zones {
+		if !zone.IsDir() {
+			continue
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(dir, zone.Name()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, zone.Name(), entry.Name())); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	log.WithField("app", app).Infoln("cache purged")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/laincloud/webrouter/nginx"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAdminMaintenancePage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webrouter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/maintenance.html", []byte("down"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a := newAdmin(dir+"/cache/", dir+"/")
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"page": "maintenance.html"}`, http.StatusNoContent},
+		{`{"page": "missing.html"}`, http.StatusBadRequest},
+		{``, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/maintenance/hello", strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%q: status %d, want %d", test.body, w.Code, test.status)
+		}
+	}
+}
+
+// TestAdminConfig checks that the config served keeps the fields set when
+// rendering, which the annotations leave out.
+func TestAdminConfig(t *testing.T) {
+	a := newAdmin("", "")
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d before a config is rendered, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	a.setConfig(nginx.Config{Servers: map[string]nginx.Server{
+		"a.org": {Locations: map[string]nginx.Location{
+			"/": {
+				Path:        "/",
+				Limit:       nginx.Limit{Rate: "10r/s", Zone: "limit_a_org_0"},
+				AuthRequest: nginx.AuthRequest{Proc: "auth.web.web", Upstream: "auth_web_web", Scheme: "http", Location: "/_webrouter_auth_0"},
+				CORS:        nginx.CORS{Origins: []string{"*"}, Variable: "$cors_a_org_0"},
+				Maintenance: nginx.Maintenance{Location: "/_webrouter_maintenance_0"},
+				Cache:       nginx.Cache{Enabled: true, Zone: "cache_a_org_0", Path: "/var/cache/a/0"},
+			},
+		}},
+	}})
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	var config struct {
+		Servers map[string]struct {
+			Locations map[string]struct {
+				Limit       struct{ Rate, Zone string }
+				AuthRequest struct{ Proc, Upstream, Scheme, Location string }
+				CORS        struct{ Variable string }
+				Maintenance struct{ Location string }
+				Cache       struct{ Zone, Path string }
+			}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	location := config.Servers["a.org"].Locations["/"]
+	tests := []struct {
+		field string
+		got   string
+		want  string
+	}{
+		{"limit rate", location.Limit.Rate, "10r/s"},
+		{"limit zone", location.Limit.Zone, "limit_a_org_0"},
+		{"auth proc", location.AuthRequest.Proc, "auth.web.web"},
+		{"auth upstream", location.AuthRequest.Upstream, "auth_web_web"},
+		{"auth scheme", location.AuthRequest.Scheme, "http"},
+		{"auth location", location.AuthRequest.Location, "/_webrouter_auth_0"},
+		{"cors variable", location.CORS.Variable, "$cors_a_org_0"},
+		{"maintenance location", location.Maintenance.Location, "/_webrouter_maintenance_0"},
+		{"cache zone", location.Cache.Zone, "cache_a_org_0"},
+		{"cache path", location.Cache.Path, "/var/cache/a/0"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: %q, want %q", test.field, test.got, test.want)
+		}
+	}
+}
+
+func TestAdminApply(t *testing.T) {
+	a := newAdmin("", "")
+	a.maintenance["a"] = nginx.Maintenance{Enabled: true}
+	a.maintenance["b"] = nginx.Maintenance{Enabled: true, Body: `{"message":"upgrading"}`, RetryAfter: 30}
+	config := nginx.Config{Servers: map[string]nginx.Server{
+		"a.org": {Locations: map[string]nginx.Location{
+			"/":   {App: "a", Maintenance: nginx.Maintenance{Page: "a.html", RetryAfter: 60}},
+			"api": {App: "b", Maintenance: nginx.Maintenance{Page: "b.html"}},
+			"c":   {App: "c"},
+		}},
+	}}
+	a.apply(&config)
+	want := map[string]nginx.Maintenance{
+		// The page and retry after of the annotation are kept by default.
+		"/":   {Enabled: true, Page: "a.html", RetryAfter: 60},
+		"api": {Enabled: true, Body: `{"message":"upgrading"}`, RetryAfter: 30},
+		"c":   {},
+	}
+	for key, location := range config.Servers["a.org"].Locations {
+		if location.Maintenance != want[key] {
+			t.Errorf("%s: maintenance %+v, want %+v", key, location.Maintenance, want[key])
+		}
+	}
+}
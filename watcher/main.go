@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"github.com/laincloud/webrouter/analyzer"
 	"github.com/laincloud/webrouter/graphite"
 	"github.com/laincloud/webrouter/lainlet"
+	"github.com/laincloud/webrouter/metrics"
 	"github.com/laincloud/webrouter/nginx"
+	"github.com/laincloud/webrouter/settings"
 	"github.com/mitchellh/copystructure"
 	"github.com/onrik/logrus/filename"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"net/http"
 	"os"
 	"os/exec"
 	"reflect"
@@ -20,107 +24,83 @@ func main() {
 	log.AddHook(filename.NewHook())
 
 	viper.SetDefault("lainlet", "lainlet.lain:9001")
-	viper.SetDefault("consul", "consul.lain:8500")
-	viper.SetDefault("nginx", "/usr/local/openresty/nginx/")
-	viper.SetDefault("pid", "/var/run/nginx.pid")
-	viper.SetDefault("log", "/var/log/nginx/")
-	viper.SetDefault("ssl", "/etc/nginx/ssl/")
-	viper.SetDefault("serverName", "localhost")
-	viper.SetDefault("prefix", "lain/webrouter/upstreams/")
-	viper.SetDefault("https", false)
-	viper.SetDefault("serverNamesHashMaxSize", 512)
-	viper.SetDefault("serverNamesHashBucketSize", 64)
-	viper.SetDefault("checkShmSize",1)
+	viper.SetDefault("analyzer", false)
+	viper.SetDefault("admin", "127.0.0.1:9090")
+	viper.SetDefault("prometheus", "")
 	viper.SetDefault("debug", false)
 	viper.SetDefault("graphite", false)
-	viper.SetDefault("ABTest", false)
-	viper.SetDefault("redisRole", "master")
-	viper.SetDefault("redisDBID", 0)
-	viper.SetDefault("redisConnectTimeout", 100)
-	viper.SetDefault("redisReadTimeout", 1000)
-	viper.SetDefault("redisKeepaliveTimeout", 60000)
-	viper.SetDefault("redisPoolSize", 30)
+	viper.SetDefault("graphiteProtocol", "tcp")
+	viper.SetDefault("graphiteFormat", "plaintext")
+	viper.SetDefault("graphitePrefix", graphite.OpenRestyPrefix)
+	viper.SetDefault("metrics", "")
+	viper.SetDefault("metricsTags", "")
+	viper.SetDefault("statsd", "127.0.0.1:8125")
+	viper.SetDefault("otlp", "http://127.0.0.1:4318/v1/metrics")
+	viper.SetDefault("streamReloadInterval", 30)
 
 	viper.BindEnv("lainlet", "LAINLET_ADDR")
-	viper.BindEnv("consul", "CONSUL_ADDR")
-	viper.BindEnv("nginx", "NGINX_PATH")
-	viper.BindEnv("pid", "NGINX_PID_PATH")
-	viper.BindEnv("log", "NGINX_LOG_PATH")
-	viper.BindEnv("ssl", "NGINX_SSL_PATH")
-	viper.BindEnv("serverName", "NGINX_SERVER_NAME")
-	viper.BindEnv("prefix", "CONSUL_KEY_PREFIX")
-	viper.BindEnv("https", "HTTPS")
-	viper.BindEnv("serverNamesHashMaxSize", "SERVER_NAMES_HASH_MAX_SIZE")
-	viper.BindEnv("serverNamesHashBucketSize", "SERVER_NAMES_HASH_BUCKET_SIZE")
-	viper.BindEnv("checkShmSize","CHECK_SHM_SIZE")
+	viper.BindEnv("analyzer", "ANALYZER_ENABLE")
+	viper.BindEnv("admin", "ADMIN_ADDR")
+	viper.BindEnv("prometheus", "PROMETHEUS_ADDR")
 	viper.BindEnv("debug", "DEBUG")
 	viper.BindEnv("graphite", "GRAPHITE_ENABLE")
 	viper.BindEnv("graphiteHost", "GRAPHITE_HOST")
 	viper.BindEnv("graphitePort", "GRAPHITE_PORT")
-	viper.BindEnv("ABTest", "AB_TEST")
-	viper.BindEnv("redisSentinel", "REDIS_SENTINEL")
-	viper.BindEnv("redisMasterName", "REDIS_MASTER_NAME")
-	viper.BindEnv("redisRole", "REDIS_ROLE")
-	viper.BindEnv("redisPassword", "REDIS_PASSWORD")
-	viper.BindEnv("redisConnectTimeout", "REDIS_CONNECT_TIMEOUT")
-	viper.BindEnv("redisReadTimeout", "REDIS_READ_TIMEOUT")
-	viper.BindEnv("redisDBID", "REDIS_DBID")
-	viper.BindEnv("redisPoolSize", "REDIS_POOL_SIZE")
-	viper.BindEnv("redisKeepaliveTimeout", "REDIS_KEEPALIVE_TIMEOUT")
+	viper.BindEnv("graphiteProtocol", "GRAPHITE_PROTOCOL")
+	viper.BindEnv("graphiteFormat", "GRAPHITE_FORMAT")
+	viper.BindEnv("graphitePrefix", "GRAPHITE_PREFIX")
+	viper.BindEnv("metrics", "METRICS_REPORTER")
+	viper.BindEnv("metricsTags", "METRICS_TAGS")
+	viper.BindEnv("statsd", "STATSD_ADDR")
+	viper.BindEnv("otlp", "OTLP_ENDPOINT")
+	viper.BindEnv("streamReloadInterval", "STREAM_RELOAD_INTERVAL")
 
 	lainletAddr := viper.GetString("lainlet")
-	pidPath := viper.GetString("pid")
 	debug := viper.GetBool("debug")
-	graphiteEnable := viper.GetBool("graphite")
-	var graphiteHost string
-	var graphitePort int
-	if graphiteEnable {
-		graphiteHost = viper.GetString("graphiteHost")
-		graphitePort = viper.GetInt("graphitePort")
+	// GRAPHITE_ENABLE is kept for the deployments predating METRICS_REPORTER.
+	metricsReporter := viper.GetString("metrics")
+	if metricsReporter == "" && viper.GetBool("graphite") {
+		metricsReporter = "graphite"
+	}
+	var reporter metrics.Reporter
+	if metricsReporter != "" {
+		tags, err := metrics.ParseTags(viper.GetString("metricsTags"))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		tags = append([]metrics.Tag{
+			{Key: "lain_domain", Value: os.Getenv("LAIN_DOMAIN")},
+			{Key: "instance", Value: os.Getenv("DEPLOYD_POD_INSTANCE_NO")},
+		}, tags...)
+		reporter, err = metrics.New(metrics.Config{
+			Reporter:  metricsReporter,
+			Component: "openresty",
+			Tags:      tags,
+			Graphite: graphite.Config{
+				Host:     viper.GetString("graphiteHost"),
+				Port:     viper.GetInt("graphitePort"),
+				Protocol: viper.GetString("graphiteProtocol"),
+				Format:   viper.GetString("graphiteFormat"),
+				Prefix:   viper.GetString("graphitePrefix"),
+			},
+			StatsDAddr:   viper.GetString("statsd"),
+			OTLPEndpoint: viper.GetString("otlp"),
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 	if debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	redisConf := nginx.RedisConf{
-		Sentinel:         viper.GetString("redisSentinel"),
-		MasterName:       viper.GetString("redisMasterName"),
-		Role:             viper.GetString("redisRole"),
-		Password:         viper.GetString("redisPassword"),
-		ConnectTimeout:   viper.GetInt("redisConnectTimeout"),
-		ReadTimeout:      viper.GetInt("redisReadTimeout"),
-		DBID:             viper.GetInt("redisDBID"),
-		PoolSize:         viper.GetInt("redisPoolSize"),
-		KeepaliveTimeout: viper.GetInt("redisKeepaliveTimeout"),
-	}
-
-	initConf := nginx.InitConf{
-		NginxPath:                 viper.GetString("nginx"),
-		LogPath:                   viper.GetString("log"),
-		ServerName:                viper.GetString("serverName"),
-		PidPath:                   viper.GetString("pid"),
-		HTTPS:                     viper.GetBool("https"),
-		SSLPath:                   viper.GetString("ssl"),
-		ServerNamesHashMaxSize:    viper.GetInt("serverNamesHashMaxSize"),
-		ServerNamesHashBucketSize: viper.GetInt("serverNamesHashBucketSize"),
-		CheckShmSize:              viper.GetInt("checkShmSize"),
-		ABTest:    viper.GetBool("ABTest"),
-		RedisConf: redisConf,
-	}
-
-	randerConf := nginx.RenderConf{
-		NginxPath:    viper.GetString("nginx"),
-		LogPath:      viper.GetString("log"),
-		HTTPS:        viper.GetBool("https"),
-		SSLPath:      viper.GetString("ssl"),
-		ConsulAddr:   viper.GetString("consul"),
-		ConsulPrefix: viper.GetString("prefix"),
-		ABTest:       viper.GetBool("ABTest"),
-		RedisConf:    redisConf,
+	initConf, randerConf, err := settings.Load()
+	if err != nil {
+		log.Fatalln(err)
 	}
+	pidPath := initConf.PidPath
 
-	err := nginx.Init(initConf)
-	if err != nil {
+	if err := nginx.Init(initConf); err != nil {
 		log.Fatalln(err)
 	}
 
@@ -135,54 +115,152 @@ func main() {
 
 	health := 0
 
-	if graphiteEnable {
+	if reporter != nil {
 		ticker := time.NewTicker(1 * time.Minute)
 		go func() {
 			for range ticker.C {
-				graphite.SendOpenRestyMetrics(graphiteHost, graphitePort, health)
+				reporter.Gauge("health", float64(health))
+				if err := reporter.Flush(); err != nil {
+					log.Errorln(err)
+				}
 			}
 		}()
 	}
 
-	var servers interface{}
+	adminServer := newAdmin(randerConf.CachePath, randerConf.ErrorPagePath)
+	if viper.GetBool("analyzer") {
+		if viper.GetString("logFormat") != "json" {
+			log.Fatalln("the access log analyzer requires NGINX_LOG_FORMAT=json")
+		}
+		logAnalyzer := analyzer.New(initConf.LogPath)
+		adminServer.metrics = logAnalyzer
+		// The admin API is not authenticated, the metrics are served on an
+		// address of their own for the scrapers out of the host.
+		if addr := viper.GetString("prometheus"); addr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", logAnalyzer)
+			go func() {
+				log.Errorln(http.ListenAndServe(addr, mux))
+			}()
+		}
+		go logAnalyzer.Run(time.Minute, func(stats []analyzer.Stat) {
+			if reporter == nil {
+				return
+			}
+			for _, stat := range stats {
+				tags := []metrics.Tag{
+					{Key: "server", Value: stat.Server},
+					{Key: "location", Value: stat.Location},
+					{Key: "upstream", Value: stat.Upstream},
+				}
+				for name, value := range stat.Metrics() {
+					reporter.Gauge("access."+name, value, tags...)
+				}
+			}
+			if err := reporter.Flush(); err != nil {
+				log.Errorln(err)
+			}
+		})
+	}
+	if addr := viper.GetString("admin"); addr != "" {
+		go func() {
+			log.Errorln(http.ListenAndServe(addr, adminServer))
+		}()
+	}
+
+	var servers, upstreams, streams, streamUpstreams, latest interface{}
+	streamReloadInterval := time.Duration(viper.GetInt("streamReloadInterval")) * time.Second
+	var reloaded time.Time
+	var streamReload <-chan time.Time
 	watchCh := lainlet.WatchConfig(lainletAddr)
 	for {
-		newConfig, ok := <-watchCh
-		if ok {
+		select {
+		case newConfig, ok := <-watchCh:
+			if !ok {
+				continue
+			}
 			if newConfig.Err != nil {
 				health = 0
 				log.Errorln(newConfig.Err)
 				continue
 			}
-			newServers, err := copystructure.Copy(newConfig.Servers)
-			if err != nil {
-				health = 0
-				log.Errorln(err)
+			latest = newConfig
+		case <-adminServer.changed:
+			if latest == nil {
 				continue
 			}
-			if err := nginx.Render(&newConfig, randerConf); err != nil {
-				health = 0
-				log.Errorln(err)
+		case <-streamReload:
+			streamReload = nil
+		}
+		copied, err := copystructure.Copy(latest)
+		if err != nil {
+			health = 0
+			log.Errorln(err)
+			continue
+		}
+		newConfig := copied.(nginx.Config)
+		adminServer.apply(&newConfig)
+		newServers, err := copystructure.Copy(newConfig.Servers)
+		if err != nil {
+			health = 0
+			log.Errorln(err)
+			continue
+		}
+		newStreams, err := copystructure.Copy(newConfig.Streams)
+		if err != nil {
+			health = 0
+			log.Errorln(err)
+			continue
+		}
+		newUpstreams := nginx.UpstreamSettings(&newConfig)
+		newStreamUpstreams := nginx.StreamUpstreams(&newConfig)
+		warnings, err := nginx.Render(&newConfig, randerConf)
+		for _, warning := range warnings {
+			log.Warnln(warning)
+		}
+		if err != nil {
+			health = 0
+			log.Errorln(err)
+			continue
+		}
+		adminServer.setConfig(newConfig)
+		cmd := exec.Command("nginx", "-t")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err != nil {
+			health = 0
+			log.Errorln(err)
+			log.Errorln(string(stderr.Bytes()))
+			continue
+		}
+		// upsync updates the servers of the http upstreams, not those of the
+		// stream upstreams which are written in stream.conf. When only they
+		// change, nginx is reloaded at most once per interval so that pods
+		// coming and going do not keep reloading it for all the traffic.
+		changed := !reflect.DeepEqual(servers, newServers) || !reflect.DeepEqual(upstreams, newUpstreams) ||
+			!reflect.DeepEqual(streams, newStreams)
+		if !changed && !reflect.DeepEqual(streamUpstreams, newStreamUpstreams) {
+			if wait := reloaded.Add(streamReloadInterval).Sub(time.Now()); wait > 0 {
+				if streamReload == nil {
+					streamReload = time.After(wait)
+				}
+				health = 1
 				continue
 			}
-			cmd := exec.Command("nginx", "-t")
-			var stderr bytes.Buffer
-			cmd.Stderr = &stderr
-			if err != nil {
+			changed = true
+		}
+		if changed {
+			if err := nginx.Reload(pidPath); err != nil {
 				health = 0
 				log.Errorln(err)
-				log.Errorln(string(stderr.Bytes()))
 				continue
 			}
-			if !reflect.DeepEqual(servers, newServers) {
-				if err := nginx.Reload(pidPath); err != nil {
-					health = 0
-					log.Errorln(err)
-					continue
-				}
-				servers = newServers
-			}
-			health = 1
+			reloaded = time.Now()
+			servers = newServers
+			upstreams = newUpstreams
+			streams = newStreams
+			streamUpstreams = newStreamUpstreams
 		}
+		health = 1
 	}
 }
@@ -0,0 +1,138 @@
+// webrouterctl inspects the routing of the webrouter: it resolves a URL to
+// the server, location and upstream handling it, lists the routes of the apps,
+// reports the conflicts between procs and renders the nginx configs offline.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/laincloud/webrouter/nginx"
+	"github.com/spf13/viper"
+	"os"
+	"strconv"
+)
+
+const usage = `usage: webrouterctl [flags] command
+
+commands:
+  resolve <url>    show how a request to the URL is routed
+  routes [app]     list the locations and streams of every app or of app
+  conflicts        list the warnings and the conflicts between procs, exit 1
+                   if there are conflicts
+  render <tmpl> <out>
+                   render the configs with the templates of the tmpl
+                   directory to the out directory, with the settings of the
+                   watcher environment variables
+
+The config is built from the webprocs of lainlet unless -file or -admin is
+given.
+
+flags:
+`
+
+func main() {
+	lainletAddr := flag.String("lainlet", env("LAINLET_ADDR", "lainlet.lain:9001"), "lainlet address")
+	file := flag.String("file", "", "webprocs payload saved from lainlet, or - for stdin")
+	admin := flag.String("admin", "", "admin address of a watcher serving its rendered config")
+	sslPath := flag.String("ssl", os.Getenv("NGINX_SSL_PATH"), "directory of the certificates, instead of those of the snapshot")
+	https := flag.Bool("https", envBool("HTTPS"), "HTTPS is enabled")
+	abTest := flag.Bool("abtest", envBool("AB_TEST"), "AB testing is enabled")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var snap *snapshot
+	var err error
+	switch {
+	case *file == "-":
+		snap, err = loadStdin()
+	case *file != "":
+		snap, err = loadFile(*file)
+	case *admin != "":
+		snap, err = loadAdmin(*admin)
+	default:
+		snap, err = loadLainlet(*lainletAddr)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	switch {
+	case args[0] == "resolve" && len(args) == 2:
+		r := &resolver{config: snap.config, https: *https, abTest: *abTest}
+		if *sslPath != "" {
+			if err := nginx.LoadCerts(*sslPath); err != nil {
+				fatal(err)
+			}
+			r.certs = true
+		}
+		fields, err := r.resolve(args[1])
+		if err != nil {
+			fatal(err)
+		}
+		for _, f := range fields {
+			fmt.Printf("%-10s %s\n", f.label+":", f.value)
+		}
+	case args[0] == "routes" && len(args) <= 2:
+		app := ""
+		if len(args) == 2 {
+			app = args[1]
+		}
+		if err := printRoutes(os.Stdout, routes(snap.config, app)); err != nil {
+			fatal(err)
+		}
+	case args[0] == "conflicts" && len(args) == 1:
+		if snap.rendered {
+			fmt.Println("the conflicts of a rendered config are logged by the watcher")
+			return
+		}
+		for _, warning := range snap.warnings {
+			fmt.Println("warning:", warning)
+		}
+		for _, conflict := range snap.conflicts {
+			fmt.Println(conflict)
+		}
+		if len(snap.conflicts) > 0 {
+			os.Exit(1)
+		}
+	case args[0] == "render" && len(args) == 3:
+		for _, conflict := range snap.conflicts {
+			fmt.Fprintln(os.Stderr, "conflict:", conflict)
+		}
+		viper.Set("https", *https)
+		viper.Set("ABTest", *abTest)
+		if *sslPath != "" {
+			viper.Set("ssl", *sslPath)
+		}
+		if err := render(snap.config, args[1], args[2]); err != nil {
+			fatal(err)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func env(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+func envBool(key string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(key))
+	return b
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "webrouterctl:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"github.com/laincloud/webrouter/nginx"
+	"github.com/laincloud/webrouter/settings"
+	"os"
+	"strings"
+)
+
+// render writes the configs of config rendered with the templates of
+// tmplPath to outPath, as the watcher would write them to the conf directory
+// of nginx, printing the warnings about what is dropped. The settings are
+// those of the watcher, so renders of different template versions can be
+// diffed. The htpasswd, CA, certificate and page files are not checked.
+func render(config nginx.Config, tmplPath, outPath string) error {
+	if !strings.HasSuffix(tmplPath, "/") {
+		tmplPath += "/"
+	}
+	if !strings.HasSuffix(outPath, "/") {
+		outPath += "/"
+	}
+	if err := os.MkdirAll(outPath, os.ModePerm); err != nil {
+		return err
+	}
+	initConf, renderConf, err := settings.Load()
+	if err != nil {
+		return err
+	}
+	initConf.Offline = true
+	initConf.TmplPath = tmplPath
+	initConf.ConfPath = outPath
+	if err := nginx.Init(initConf); err != nil {
+		return err
+	}
+	warnings, err := nginx.Render(&config, renderConf)
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning:", warning)
+	}
+	return err
+}
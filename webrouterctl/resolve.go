@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"github.com/laincloud/webrouter/nginx"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// field is a line of the resolve output.
+type field struct {
+	label string
+	value string
+}
+
+// resolver resolves URLs the way the rendered nginx config routes them.
+type resolver struct {
+	config nginx.Config
+	https  bool
+	abTest bool
+	// certs is set when the certificates were loaded, otherwise the
+	// certificates of the snapshot are used.
+	certs bool
+}
+
+// serverName is a name of a server block in the order nginx reads them.
+type serverName struct {
+	name     string
+	owner    string
+	redirect bool
+}
+
+func (r *resolver) cert(owner string) string {
+	if !r.https {
+		return ""
+	}
+	if r.certs {
+		return nginx.SSLCert(owner, r.config.Servers[owner])
+	}
+	return r.config.Servers[owner].SSL
+}
+
+// serverNames lists the server names listening for the scheme, in the order
+// of the server blocks of server.conf.
+func (r *resolver) serverNames(tls bool) []serverName {
+	var owners []string
+	for owner := range r.config.Servers {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	var names, redirects []serverName
+	for _, owner := range owners {
+		if tls && r.cert(owner) == "" {
+			continue
+		}
+		server := r.config.Servers[owner]
+		names = append(names, serverName{name: owner, owner: owner})
+		for _, alias := range server.Aliases {
+			if server.RedirectAliases {
+				redirects = append(redirects, serverName{name: alias, owner: owner, redirect: true})
+			} else {
+				names = append(names, serverName{name: alias, owner: owner})
+			}
+		}
+		names = append(names, redirects...)
+		redirects = nil
+	}
+	return names
+}
+
+// matchServer picks the server of host like nginx: an exact name, then the
+// longest leading wildcard, the longest trailing wildcard and the first
+// matching regex.
+func matchServer(names []serverName, host string) (serverName, bool) {
+	var leading, trailing serverName
+	for _, n := range names {
+		name := strings.ToLower(n.name)
+		switch {
+		case strings.HasPrefix(name, "~"):
+		case name == host:
+			return n, true
+		case strings.HasPrefix(name, "."):
+			if (host == name[1:] || strings.HasSuffix(host, name)) && len(name) > len(leading.name) {
+				leading = n
+			}
+		case strings.HasPrefix(name, "*."):
+			if strings.HasSuffix(host, name[1:]) && len(name) > len(leading.name) {
+				leading = n
+			}
+		case strings.HasSuffix(name, ".*"):
+			if strings.HasPrefix(host, name[:len(name)-1]) && len(name) > len(trailing.name) {
+				trailing = n
+			}
+		}
+	}
+	if leading.name != "" {
+		return leading, true
+	}
+	if trailing.name != "" {
+		return trailing, true
+	}
+	for _, n := range names {
+		if !strings.HasPrefix(n.name, "~") {
+			continue
+		}
+		if re, err := compile(n.name[1:]); err == nil && re.MatchString(host) {
+			return n, true
+		}
+	}
+	return serverName{}, false
+}
+
+// compile compiles a PCRE regex of the config, with its named groups
+// translated to the Go syntax.
+func compile(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(strings.Replace(pattern, "(?<", "(?P<", -1))
+}
+
+func exactPath(location nginx.Location) string {
+	if location.Path == "/" {
+		return "/"
+	}
+	return "/" + location.Path
+}
+
+func proxies(location nginx.Location) bool {
+	return !location.SlashRedirect && !location.Maintenance.Enabled
+}
+
+// matchLocation picks the location of uri like nginx: an exact location,
+// then the longest prefix unless a regex location matches. Regex locations
+// are tried in the order server.conf.tmpl renders them, which is the sorted
+// order of the keys as text/template ranges over maps that way. A prefix
+// location passing requests to an upstream redirects its path without the
+// trailing slash, which is reported with redirect when no regex location
+// matches either.
+func matchLocation(server nginx.Server, uri string) (key string, redirect bool, err error) {
+	var keys []string
+	for key := range server.Locations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	prefix := ""
+	for _, key := range keys {
+		location := server.Locations[key]
+		switch location.Match {
+		case "exact":
+			if uri == exactPath(location) {
+				return key, false, nil
+			}
+		case "regex":
+		default:
+			pattern := location.Pattern()
+			if uri+"/" == pattern && proxies(location) {
+				prefix, redirect = key, true
+			}
+			if !redirect && strings.HasPrefix(uri, pattern) && (prefix == "" || len(pattern) > len(server.Locations[prefix].Pattern())) {
+				prefix = key
+			}
+		}
+	}
+	for _, key := range keys {
+		location := server.Locations[key]
+		if location.Match != "regex" {
+			continue
+		}
+		re, err := compile("^/" + location.Path)
+		if err != nil {
+			return "", false, errors.New("location " + location.Pattern() + " cannot be evaluated: " + err.Error() + " !")
+		}
+		if re.MatchString(uri) {
+			return key, false, nil
+		}
+	}
+	return prefix, redirect, nil
+}
+
+// normalize returns the path nginx matches locations against: decoded, with
+// merged slashes and resolved dot segments.
+func normalize(p string) string {
+	if p == "" {
+		return "/"
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// rewrite returns the URI passed to the upstream by the prefix rewrite of
+// the location, without the query string.
+func rewrite(location nginx.Location, uri string) string {
+	if location.KeepPrefix {
+		return uri
+	}
+	replace := location.ReplacePrefix
+	if replace == "" {
+		if location.Path == "/" {
+			return uri
+		}
+		replace = "/"
+	}
+	switch location.Match {
+	case "exact":
+		return replace
+	case "regex":
+		re, err := compile("^/(?:" + location.Path + ")/?(?P<webrouter_path>.*)$")
+		if err != nil {
+			return uri
+		}
+		if m := re.FindStringSubmatch(uri); m != nil {
+			return replace + m[len(m)-1]
+		}
+		return uri
+	}
+	return replace + strings.TrimPrefix(uri, location.Pattern())
+}
+
+var captureRegexp = regexp.MustCompile(`\$([0-9])`)
+
+// redirect applies the first redirect rule of the location matching uri. It
+// returns the status and destination of a redirect, or 0 and the rewritten
+// URI with its query string.
+func redirect(location nginx.Location, uri, query string) (int, string, bool, error) {
+	for _, rule := range location.Redirects {
+		re, err := compile(rule.Match)
+		if err != nil {
+			return 0, "", false, errors.New("redirect " + rule.Match + " cannot be evaluated: " + err.Error() + " !")
+		}
+		m := re.FindStringSubmatch(uri)
+		if m == nil {
+			continue
+		}
+		target := captureRegexp.ReplaceAllStringFunc(rule.Target, func(s string) string {
+			if i := int(s[1] - '0'); i < len(m) {
+				return m[i]
+			}
+			return ""
+		})
+		if rule.PreserveQuery && query != "" {
+			target += "?" + query
+		}
+		return rule.Status, target, true, nil
+	}
+	return 0, "", false, nil
+}
+
+// resolve returns how a request to rawURL is routed.
+func (r *resolver) resolve(rawURL string) ([]field, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("scheme: " + u.Scheme + " must be http or https !")
+	}
+	tls := u.Scheme == "https"
+	host := strings.ToLower(u.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	uri := normalize(u.Path)
+	requestURI := u.RequestURI()
+	fields := []field{{"url", u.String()}}
+
+	if tls && !r.https {
+		return append(fields, field{"action", "444, HTTPS is disabled and the default server closes the connection"}), nil
+	}
+	n, ok := matchServer(r.serverNames(tls), host)
+	if !ok {
+		if n, ok := matchServer(r.serverNames(false), host); ok && tls {
+			return append(fields, field{"server", n.owner}, field{"action", "444, no certificate covers the server and the default server closes the connection"}), nil
+		}
+		return append(fields, field{"action", "444, no server name matches and the default server closes the connection"}), nil
+	}
+	server := r.config.Servers[n.owner]
+	if n.name == n.owner {
+		fields = append(fields, field{"server", n.owner})
+	} else {
+		fields = append(fields, field{"server", n.owner + " (" + n.name + ")"})
+	}
+	cert := r.cert(n.owner)
+	if tls {
+		fields = append(fields, field{"tls", cert + ".crt"})
+	}
+	if n.redirect {
+		return append(fields, field{"action", "301 " + u.Scheme + "://" + n.owner + requestURI}), nil
+	}
+	if len(server.Access.Rules()) > 0 {
+		fields = append(fields, field{"access", strings.Join(server.Access.Rules(), ", ")})
+	}
+
+	key, autoRedirect, err := matchLocation(server, uri)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return append(fields, field{"action", "404, no location matches"}), nil
+	}
+	location := server.Locations[key]
+	fields = append(fields, field{"location", location.Pattern()})
+	if autoRedirect {
+		return append(fields, field{"action", "301 " + uri + "/" + query(u)}), nil
+	}
+	fields = append(fields, field{"proc", location.Proc}, field{"upstream", r.upstream(location.Upstream)})
+	if location.SlashRedirect {
+		return append(fields, field{"action", "301 /" + location.Path + "/" + query(u)}), nil
+	}
+	if location.Maintenance.Enabled {
+		return append(fields, field{"action", "503, under maintenance"}), nil
+	}
+	if !tls && cert != "" && (location.HttpsOnly || location.ClientAuth.Verify == "on" || location.GRPC()) {
+		return append(fields, field{"action", "301 https://" + host + requestURI}), nil
+	}
+	fields = append(fields, r.checks(location, tls)...)
+	status, target, redirected, err := redirect(location, uri, u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	if redirected && status != 0 {
+		return append(fields, field{"action", strconv.Itoa(status) + " " + target}), nil
+	}
+	passed := rewrite(location, uri) + query(u)
+	if redirected {
+		passed = target
+	}
+	fields = append(fields, field{"action", "proxy to " + location.Scheme() + "://" + location.Upstream + passed})
+	canary := location.Upstream + "_canary"
+	if _, ok := r.config.Upstreams[canary]; ok {
+		switch {
+		case location.ABTest || r.abTest && nginx.ABTestable(n.owner, location):
+			fields = append(fields, field{"canary", r.upstream(canary) + ", diverted by the AB testing policy"})
+		case r.abTest:
+			fields = append(fields, field{"canary", r.upstream(canary) + ", unused as the location cannot be AB tested"})
+		default:
+			fields = append(fields, field{"canary", r.upstream(canary) + ", unused as AB testing is disabled"})
+		}
+	}
+	for _, mirror := range location.Mirrors {
+		fields = append(fields, field{"mirror", r.upstream(mirror.Upstream) + ", " + strconv.Itoa(mirror.Percentage) + "% of the requests"})
+	}
+	if location.Cache.Enabled {
+		fields = append(fields, field{"cache", "enabled"})
+	}
+	return fields, nil
+}
+
+func query(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	return "?" + u.RawQuery
+}
+
+// upstream describes an upstream and its servers.
+func (r *resolver) upstream(name string) string {
+	upstream, ok := r.config.Upstreams[name]
+	if !ok {
+		return name + " (missing)"
+	}
+	servers := upstream.Servers
+	if len(servers) == 1 && servers[0] == "127.0.0.1:11111" {
+		return name + " (no servers)"
+	}
+	return name + " (" + strings.Join(servers, ", ") + ")"
+}
+
+// checks lists what the location checks before proxying the request.
+func (r *resolver) checks(location nginx.Location, tls bool) []field {
+	var fields []field
+	if tls && location.ClientAuth.Verify == "on" {
+		fields = append(fields, field{"check", "client certificate signed by " + location.ClientAuth.CA + ".ca.pem, 403 otherwise"})
+	}
+	if rules := location.Access.Rules(); len(rules) > 0 {
+		fields = append(fields, field{"check", strings.Join(rules, ", ")})
+	}
+	if location.BasicAuth.File != "" {
+		fields = append(fields, field{"check", "basic auth against " + location.BasicAuth.File + ".htpasswd"})
+	}
+	if location.AuthRequest.Proc != "" {
+		fields = append(fields, field{"check", "auth request to " + location.AuthRequest.Proc + location.AuthRequest.URI})
+	}
+	return fields
+}
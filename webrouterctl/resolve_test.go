@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/laincloud/webrouter/nginx"
+	"testing"
+)
+
+func TestMatchLocation(t *testing.T) {
+	server := nginx.Server{Locations: map[string]nginx.Location{
+		"/":           {Path: "/"},
+		"api":         {Path: "api"},
+		"api/v2":      {Path: "api/v2"},
+		"=api/status": {Match: "exact", Path: "api/status"},
+		"=/":          {Match: "exact", Path: "/"},
+		"~img/.*":     {Match: "regex", Path: "img/.*"},
+		"~api/v2/.*":  {Match: "regex", Path: "api/v2/.*"},
+		"~api/v.*":    {Match: "regex", Path: "api/v.*"},
+		"~docs":       {Match: "regex", Path: "docs"},
+		"docs":        {Path: "docs"},
+		"old":         {Path: "old", SlashRedirect: true},
+	}}
+	tests := []struct {
+		uri      string
+		key      string
+		redirect bool
+	}{
+		{"/", "=/", false},
+		{"/index.html", "/", false},
+		{"/api/status", "=api/status", false},
+		{"/api/status/", "api", false},
+		{"/api/users", "api", false},
+		{"/api/v2/users", "~api/v.*", false},
+		{"/img/a.png", "~img/.*", false},
+		{"/api", "api", true},
+		{"/api/v2", "~api/v.*", false},
+		{"/docs", "~docs", false},
+		{"/docs/", "~docs", false},
+		{"/old", "/", false},
+		{"/old/a", "old", false},
+	}
+	for _, test := range tests {
+		key, redirect, err := matchLocation(server, test.uri)
+		if err != nil {
+			t.Errorf("%q: %s", test.uri, err)
+			continue
+		}
+		if key != test.key || redirect != test.redirect {
+			t.Errorf("%q: location %q redirect %t, want %q redirect %t", test.uri, key, redirect, test.key, test.redirect)
+		}
+	}
+}
+
+func TestMatchLocationInvalid(t *testing.T) {
+	server := nginx.Server{Locations: map[string]nginx.Location{
+		"~a(": {Match: "regex", Path: "a("},
+	}}
+	if _, _, err := matchLocation(server, "/a"); err == nil {
+		t.Error("invalid regex location matched")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/a/b/", "/a/b/"},
+		{"//a///b", "/a/b"},
+		{"/a//", "/a/"},
+		{"/a/../b", "/b"},
+		{"/a/./b/", "/a/b/"},
+		{"/../a", "/a"},
+		{"/a/..", "/"},
+		{"a/b", "/a/b"},
+	}
+	for _, test := range tests {
+		if got := normalize(test.path); got != test.want {
+			t.Errorf("%q: normalized to %q, want %q", test.path, got, test.want)
+		}
+	}
+}
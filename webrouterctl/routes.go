@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"github.com/laincloud/webrouter/nginx"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type route struct {
+	app      string
+	proc     string
+	server   string
+	location string
+	upstream string
+	notes    []string
+}
+
+// routes lists the locations and streams of the config, of every app or of
+// app only, sorted by app, server and location.
+func routes(config nginx.Config, app string) []route {
+	var routes []route
+	for serverName, server := range config.Servers {
+		for _, location := range server.Locations {
+			if app != "" && location.App != app {
+				continue
+			}
+			r := route{
+				app:      location.App,
+				proc:     location.Proc,
+				server:   serverName,
+				location: location.Pattern(),
+				upstream: location.Upstream,
+			}
+			if len(server.Aliases) > 0 {
+				aliases := "aliases " + strings.Join(server.Aliases, " ")
+				if server.RedirectAliases {
+					aliases += " (redirected)"
+				}
+				r.notes = append(r.notes, aliases)
+			}
+			switch {
+			case location.SlashRedirect:
+				r.notes = append(r.notes, "redirects to /"+location.Path+"/")
+			case location.Maintenance.Enabled:
+				r.notes = append(r.notes, "maintenance")
+			case location.HttpsOnly:
+				r.notes = append(r.notes, "https only")
+			}
+			if len(location.Redirects) > 0 {
+				r.notes = append(r.notes, strconv.Itoa(len(location.Redirects))+" redirects")
+			}
+			if _, ok := config.Upstreams[location.Upstream+"_canary"]; ok {
+				r.notes = append(r.notes, "canary")
+			}
+			for _, mirror := range location.Mirrors {
+				r.notes = append(r.notes, "mirrored to "+mirror.Upstream)
+			}
+			routes = append(routes, r)
+		}
+	}
+	for _, stream := range config.Streams {
+		upstreams := make(map[string]string)
+		if stream.Upstream != "" {
+			upstreams[""] = stream.Upstream
+		}
+		for serverName, upstream := range stream.SNI {
+			upstreams[serverName] = upstream
+		}
+		for serverName, upstream := range upstreams {
+			proc := config.Upstreams[upstream]
+			if app != "" && proc.App != app {
+				continue
+			}
+			r := route{
+				app:      proc.App,
+				proc:     proc.Proc,
+				server:   serverName,
+				location: stream.Protocol + "/" + strconv.Itoa(stream.Port),
+				upstream: upstream,
+			}
+			if stream.TLS != "" {
+				r.notes = append(r.notes, "tls "+stream.TLS)
+			}
+			routes = append(routes, r)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if a.app != b.app {
+			return a.app < b.app
+		}
+		if a.server != b.server {
+			return a.server < b.server
+		}
+		return a.location < b.location
+	})
+	return routes
+}
+
+func printRoutes(w io.Writer, routes []route) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "APP\tPROC\tSERVER\tLOCATION\tUPSTREAM\tNOTES")
+	for _, r := range routes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.app, r.proc, r.server, r.location, r.upstream, strings.Join(r.notes, ", "))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"github.com/laincloud/webrouter/nginx"
+	"strings"
+	"testing"
+)
+
+func TestRoutesStreams(t *testing.T) {
+	config := nginx.Config{
+		Upstreams: map[string]nginx.Upstream{
+			"my_app_worker_redis__redis": {Proc: "my_app.worker.redis", App: "my_app", Servers: []string{"172.20.0.1:6379"}},
+			"my_app_worker_tls":          {Proc: "my_app.worker.tls", App: "my_app", Servers: []string{"172.20.0.2:8443"}},
+			"other_worker_tls":           {Proc: "other.worker.tls", App: "other", Servers: []string{"172.20.0.3:8443"}},
+		},
+		Streams: map[string]nginx.StreamServer{
+			"tcp_6379": {Port: 6379, Protocol: "tcp", Upstream: "my_app_worker_redis__redis"},
+			"tcp_8443": {Port: 8443, Protocol: "tcp", TLS: "passthrough", SNI: map[string]string{
+				"a.org": "my_app_worker_tls",
+				"b.org": "other_worker_tls",
+			}},
+		},
+	}
+	tests := []struct {
+		app  string
+		want []string
+	}{
+		{"", []string{
+			"APP     PROC                 SERVER  LOCATION  UPSTREAM                    NOTES",
+			"my_app  my_app.worker.redis          tcp/6379  my_app_worker_redis__redis  ",
+			"my_app  my_app.worker.tls    a.org   tcp/8443  my_app_worker_tls           tls passthrough",
+			"other   other.worker.tls     b.org   tcp/8443  other_worker_tls            tls passthrough",
+		}},
+		{"my_app", []string{
+			"APP     PROC                 SERVER  LOCATION  UPSTREAM                    NOTES",
+			"my_app  my_app.worker.redis          tcp/6379  my_app_worker_redis__redis  ",
+			"my_app  my_app.worker.tls    a.org   tcp/8443  my_app_worker_tls           tls passthrough",
+		}},
+		{"my", []string{
+			"APP  PROC  SERVER  LOCATION  UPSTREAM  NOTES",
+		}},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := printRoutes(&b, routes(config, test.app)); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%q: routes\n%s\nwant\n%s", test.app, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestRoutesLocations(t *testing.T) {
+	config := nginx.Config{
+		Upstreams: map[string]nginx.Upstream{
+			"shop_web_web":                {Proc: "shop.web.web", App: "shop"},
+			"shop_web_web_canary":         {Proc: "shop.web.web", App: "shop"},
+			"shop_web_web__admin":         {Proc: "shop.web.web", App: "shop"},
+			"shop_web_web__admin_canary":  {Proc: "shop.web.web", App: "shop"},
+			"shop_web_api__metrics":       {Proc: "shop.web.api", App: "shop"},
+			"shop_web_api__metrics__test": {Proc: "shop.web.api", App: "shop"},
+		},
+		Servers: map[string]nginx.Server{
+			"shop.org": {Locations: map[string]nginx.Location{
+				"/":       {App: "shop", Proc: "shop.web.web", Upstream: "shop_web_web", Path: "/"},
+				"admin":   {App: "shop", Proc: "shop.web.web", Upstream: "shop_web_web__admin", Path: "admin"},
+				"metrics": {App: "shop", Proc: "shop.web.api", Upstream: "shop_web_api__metrics", Path: "metrics", HttpsOnly: true},
+			}},
+		},
+	}
+	want := []string{
+		"APP   PROC          SERVER    LOCATION   UPSTREAM               NOTES",
+		"shop  shop.web.web  shop.org  /          shop_web_web           canary",
+		"shop  shop.web.web  shop.org  /admin/    shop_web_web__admin    canary",
+		"shop  shop.web.api  shop.org  /metrics/  shop_web_api__metrics  https only",
+	}
+	var b bytes.Buffer
+	if err := printRoutes(&b, routes(config, "shop")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSuffix(b.String(), "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("routes\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/laincloud/webrouter/lainlet"
+	"github.com/laincloud/webrouter/nginx"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// snapshot is the config routes are resolved against. Configs built from a
+// webprocs payload carry the warnings and the conflicts found between procs,
+// the watcher renders them keeping the first declaration of each conflict.
+type snapshot struct {
+	config    nginx.Config
+	warnings  []error
+	conflicts []error
+	rendered  bool
+}
+
+// loadPayload builds the config of a webprocs payload, either the JSON data
+// map or the event stream lainlet sends while watching, of which the last
+// payload is used.
+func loadPayload(b []byte) (*snapshot, error) {
+	b = bytes.TrimSpace(b)
+	var data map[string]lainlet.CoreInfoForWebrouter
+	if bytes.HasPrefix(b, []byte("{")) {
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+	} else {
+		stream := lainlet.NewStream(bytes.NewReader(b))
+		for {
+			payload, err := stream.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if payload.Err != nil {
+				return nil, payload.Err
+			}
+			data = payload.Data
+		}
+		if data == nil {
+			return nil, errors.New("no data in the webprocs payload !")
+		}
+	}
+	routing := lainlet.Parse(data)
+	return &snapshot{config: routing.Config, warnings: routing.Warnings, conflicts: routing.Errors}, nil
+}
+
+func loadFile(path string) (*snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return loadPayload(b)
+}
+
+func loadStdin() (*snapshot, error) {
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return loadPayload(b)
+}
+
+func loadLainlet(addr string) (*snapshot, error) {
+	b, err := get("http://" + addr + "/v2/webrouter/webprocs")
+	if err != nil {
+		return nil, err
+	}
+	return loadPayload(b)
+}
+
+// loadAdmin loads the config last rendered by a watcher, which includes the
+// maintenance toggled through its admin API.
+func loadAdmin(addr string) (*snapshot, error) {
+	b, err := get("http://" + addr + "/config")
+	if err != nil {
+		return nil, err
+	}
+	var config nginx.Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+	return &snapshot{config: config, rendered: true}, nil
+}
+
+func get(url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(url + ": " + resp.Status + " " + string(bytes.TrimSpace(b)) + " !")
+	}
+	return b, nil
+}